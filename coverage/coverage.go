@@ -0,0 +1,228 @@
+// Package coverage records which instructions and branches a VM executes and
+// reports them against the program's source lines.
+package coverage
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+// Conditional jumps, their branches are reported as taken or not taken
+var conditional = map[byte]bool{
+	vm.JumpGtz:  true,
+	vm.JumpLtz:  true,
+	vm.JumpEq:   true,
+	vm.JumpNeq:  true,
+	vm.JumpZGtz: true,
+	vm.JumpZLtz: true,
+	vm.JumpZEq:  true,
+	vm.JumpZNeq: true,
+}
+
+// file is the coverage of one program
+type file struct {
+	name string
+	prog *vm.Program
+
+	counts   []int64 // Executions by address
+	target   []int64 // Jump target of conditional jumps by address, -1 for other addresses
+	taken    []int64
+	notTaken []int64
+}
+
+// Coverage records the instructions executed by one or more VMs. Runs of
+// the same program are merged.
+type Coverage struct {
+	files []*file
+}
+
+// New creates an empty Coverage
+func New() *Coverage {
+	return &Coverage{}
+}
+
+// Attach records the instructions executed by a VM
+func (c *Coverage) Attach(machine *vm.VM) {
+	var f *file
+	last := int64(-1)
+
+	machine.AddHook(func(machine *vm.VM) {
+		pc := machine.PC()
+		if f == nil {
+			// Set up on the first instruction, once the program has been verified
+			f = c.file(machine.Program())
+		}
+		if pc < 0 || pc >= int64(len(f.counts)) {
+			return // Not an instruction, the VM reports it
+		}
+
+		if last >= 0 && last < int64(len(f.target)) && f.target[last] >= 0 {
+			if pc == f.target[last] {
+				f.taken[last]++
+			} else {
+				f.notTaken[last]++
+			}
+		}
+
+		f.counts[pc]++
+		last = pc
+	})
+}
+
+// file finds the record for a program or adds one
+func (c *Coverage) file(p *vm.Program) *file {
+	name := p.Source
+	if name == "" {
+		name = "<program>"
+	}
+
+	for _, f := range c.files {
+		if f.name == name && len(f.counts) == len(p.Code) {
+			return f
+		}
+	}
+
+	size := len(p.Code)
+	f := &file{
+		name:     name,
+		prog:     p,
+		counts:   make([]int64, size),
+		target:   make([]int64, size),
+		taken:    make([]int64, size),
+		notTaken: make([]int64, size),
+	}
+	for i := range f.target {
+		f.target[i] = -1
+	}
+
+	for addr := int64(0); addr < int64(size); {
+		inst, err := p.Decode(addr)
+		if err != nil {
+			break
+		}
+		if conditional[inst.Opcode] {
+			f.target[addr] = inst.Operands[0].Int
+		}
+		addr += inst.Size
+	}
+
+	c.files = append(c.files, f)
+	return f
+}
+
+// line is the coverage of a source line
+type line struct {
+	number   int
+	hits     int64
+	branches []int64 // Address of each conditional jump on the line
+}
+
+// lines returns the coverage of each source line with an instruction on it
+func (f *file) lines() []*line {
+	byNumber := make(map[int]*line)
+	var result []*line
+	for _, entry := range f.prog.Lines {
+		if entry.Addr < 0 || entry.Addr >= int64(len(f.counts)) {
+			continue
+		}
+
+		l, ok := byNumber[entry.Line]
+		if !ok {
+			l = &line{number: entry.Line}
+			byNumber[entry.Line] = l
+			result = append(result, l)
+		}
+		if count := f.counts[entry.Addr]; count > l.hits {
+			l.hits = count
+		}
+		if f.target[entry.Addr] >= 0 {
+			l.branches = append(l.branches, entry.Addr)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].number < result[j].number })
+	return result
+}
+
+// WriteLCOV writes the coverage in the lcov tracefile format read by genhtml
+// and most editors. Each conditional jump is a block with a taken and a not
+// taken branch.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	for _, f := range c.files {
+		fmt.Fprintln(w, "TN:")
+		fmt.Fprintf(w, "SF:%s\n", f.name)
+
+		var linesHit, branches, branchesHit int
+		lines := f.lines()
+		for _, l := range lines {
+			for _, addr := range l.branches {
+				for i, taken := range []int64{f.taken[addr], f.notTaken[addr]} {
+					count := "-" // The jump was never reached
+					if f.counts[addr] > 0 {
+						count = fmt.Sprint(taken)
+					}
+					fmt.Fprintf(w, "BRDA:%d,%d,%d,%s\n", l.number, addr, i, count)
+
+					branches++
+					if taken > 0 {
+						branchesHit++
+					}
+				}
+			}
+		}
+		fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", branches, branchesHit)
+
+		for _, l := range lines {
+			fmt.Fprintf(w, "DA:%d,%d\n", l.number, l.hits)
+			if l.hits > 0 {
+				linesHit++
+			}
+		}
+		fmt.Fprintf(w, "LF:%d\nLH:%d\n", len(lines), linesHit)
+
+		if _, err := fmt.Fprintln(w, "end_of_record"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Summary writes the percentage of lines and branches covered in each file
+func (c *Coverage) Summary(w io.Writer) {
+	for _, f := range c.files {
+		lines := f.lines()
+		if len(lines) == 0 {
+			fmt.Fprintf(w, "%s: no line information\n", f.name)
+			continue
+		}
+
+		var linesHit, branches, branchesHit int
+		for _, l := range lines {
+			if l.hits > 0 {
+				linesHit++
+			}
+			for _, addr := range l.branches {
+				branches += 2
+				if f.taken[addr] > 0 {
+					branchesHit++
+				}
+				if f.notTaken[addr] > 0 {
+					branchesHit++
+				}
+			}
+		}
+
+		fmt.Fprintf(w, "%s: %s of lines (%d/%d)", f.name, percent(linesHit, len(lines)), linesHit, len(lines))
+		if branches > 0 {
+			fmt.Fprintf(w, ", %s of branches (%d/%d)", percent(branchesHit, branches), branchesHit, branches)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func percent(n, total int) string {
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+}
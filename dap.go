@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/elemental-vm/test-vm/debugger"
+)
+
+func dapCommand(args []string) int {
+	flags := flag.NewFlagSet("dap", flag.ExitOnError)
+	listen := flags.String("listen", "", "Accept a client on this address instead of using stdin and stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: dap [-listen addr]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	if *listen == "" {
+		if err := debugger.NewDAP(os.Stdin, os.Stdout).Serve(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Listening on %s\n", ln.Addr())
+
+	conn, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	if err := debugger.NewDAP(conn, conn).Serve(context.Background()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/elemental-vm/test-vm/debugger"
+	"github.com/elemental-vm/test-vm/hosts"
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+func debugCommand(args []string) int {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	legacy := flags.Bool("legacy-calls", false, "CALL and RETURN only use $RT and $FP, no call stack")
+	checked := flags.Bool("checked", false, "Fault on integer overflow instead of wrapping around")
+	heapLimit := flags.Int64("heap-limit", 0, "Most array items the program can make, 0 for no limit")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: debug [-legacy-calls] [-checked] [-heap-limit items] program")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	program, err := loadProgram(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	var opts []vm.Option
+	if *legacy {
+		opts = append(opts, vm.WithLegacyCalls())
+	}
+	if *checked {
+		opts = append(opts, vm.WithCheckedArithmetic())
+	}
+	if *heapLimit > 0 {
+		opts = append(opts, vm.WithHeapLimit(*heapLimit))
+	}
+
+	machine := vm.Load(program, opts...)
+	if err := hosts.Register(machine); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	code, err := debugger.New(machine, os.Stdin, os.Stderr).Run(context.Background())
+	if rerr, ok := err.(*vm.RuntimeError); ok && rerr.Kind == vm.ErrCancelled {
+		return int(code) // Stopped from the debugger
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	return int(code)
+}
@@ -0,0 +1,594 @@
+package debugger
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elemental-vm/test-vm/hosts"
+	"github.com/elemental-vm/test-vm/lexer"
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+// The VM runs a single thread
+const dapThreadID = 1
+
+// Variable references for the scopes of a paused program
+const (
+	dapRegisters = iota + 1
+	dapStack
+)
+
+// DAP serves the Debug Adapter Protocol so editors can debug a program. Each
+// session launches one program.
+type DAP struct {
+	ctx context.Context
+	r   *bufio.Reader
+	w   io.Writer
+
+	mu  sync.Mutex // Guards writes to w
+	seq int
+
+	d       *Debugger
+	machine *vm.VM
+	source  string // Absolute path of the program's source
+
+	started bool
+	paused  int32         // Set while the program waits in onPause
+	resume  chan struct{} // Continues a paused program
+	quit    chan struct{} // Closed to stop the program
+	done    chan struct{} // Closed once the program has ended
+
+	after []func() // Run once the current response has been sent
+}
+
+type dapHeader struct {
+	Seq  int    `json:"seq"`
+	Type string `json:"type"`
+}
+
+func (h *dapHeader) setSeq(seq int) {
+	h.Seq = seq
+}
+
+type dapRequest struct {
+	dapHeader
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	dapHeader
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	dapHeader
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	ID       int    `json:"id,omitempty"`
+	Verified bool   `json:"verified"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+type dapStackFrame struct {
+	ID               int        `json:"id"`
+	Name             string     `json:"name"`
+	Source           *dapSource `json:"source,omitempty"`
+	Line             int        `json:"line"`
+	Column           int        `json:"column"`
+	InstructionPtr   string     `json:"instructionPointerReference"`
+	PresentationHint string     `json:"presentationHint,omitempty"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// NewDAP creates a server that reads requests from r and writes responses
+// and events to w
+func NewDAP(r io.Reader, w io.Writer) *DAP {
+	return &DAP{
+		r:      bufio.NewReader(r),
+		w:      w,
+		resume: make(chan struct{}),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+type dapHandler func(s *DAP, args json.RawMessage) (interface{}, error)
+
+var dapHandlers map[string]dapHandler
+
+func init() {
+	dapHandlers = map[string]dapHandler{
+		"initialize":              (*DAP).initialize,
+		"launch":                  (*DAP).launch,
+		"setBreakpoints":          (*DAP).setBreakpoints,
+		"setExceptionBreakpoints": (*DAP).ignore,
+		"configurationDone":       (*DAP).configurationDone,
+		"threads":                 (*DAP).threads,
+		"stackTrace":              (*DAP).stackTrace,
+		"scopes":                  (*DAP).scopes,
+		"variables":               (*DAP).variables,
+		"continue":                (*DAP).continueRequest,
+		"next":                    (*DAP).next,
+		"stepIn":                  (*DAP).stepIn,
+		"stepOut":                 (*DAP).stepOut,
+		"pause":                   (*DAP).pause,
+		"terminate":               (*DAP).terminate,
+		"disconnect":              (*DAP).terminate,
+	}
+}
+
+// Serve handles requests until the client disconnects. The program is
+// stopped if it's still running.
+func (s *DAP) Serve(ctx context.Context) error {
+	s.ctx = ctx
+	for {
+		req, err := s.read()
+		if err == io.EOF {
+			s.stop()
+			return nil
+		}
+		if err != nil {
+			s.stop()
+			return err
+		}
+
+		resp := &dapResponse{
+			dapHeader:  dapHeader{Type: "response"},
+			RequestSeq: req.Seq,
+			Command:    req.Command,
+			Success:    true,
+		}
+		if handler, ok := dapHandlers[req.Command]; ok {
+			resp.Body, err = handler(s, req.Arguments)
+		} else {
+			err = fmt.Errorf("Unsupported request %s", req.Command)
+		}
+		if err != nil {
+			resp.Success = false
+			resp.Message = err.Error()
+		}
+		s.send(resp)
+
+		for _, f := range s.after {
+			f()
+		}
+		s.after = nil
+
+		if req.Command == "disconnect" {
+			return nil
+		}
+	}
+}
+
+// read reads a request, which is a JSON body preceded by a Content-Length header
+func (s *DAP) read() (*dapRequest, error) {
+	length := -1
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if v := strings.TrimPrefix(line, "Content-Length:"); v != line {
+			length, err = strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Content-Length %q", v)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("Missing Content-Length header")
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, err
+	}
+
+	req := &dapRequest{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *DAP) send(msg interface{ setSeq(int) }) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	msg.setSeq(s.seq)
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n", len(data))
+	s.w.Write(data)
+}
+
+func (s *DAP) event(name string, body interface{}) {
+	s.send(&dapEvent{
+		dapHeader: dapHeader{Type: "event"},
+		Event:     name,
+		Body:      body,
+	})
+}
+
+func (s *DAP) output(category, text string) {
+	s.event("output", map[string]string{"category": category, "output": text})
+}
+
+// dapOutput sends program output to the client as output events
+type dapOutput struct {
+	s        *DAP
+	category string
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.s.output(o.category, string(p))
+	return len(p), nil
+}
+
+func (s *DAP) initialize(args json.RawMessage) (interface{}, error) {
+	return map[string]bool{
+		"supportsConfigurationDoneRequest": true,
+		"supportsTerminateRequest":         true,
+	}, nil
+}
+
+func (s *DAP) ignore(args json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *DAP) launch(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+		LegacyCalls bool   `json:"legacyCalls"`
+		Checked     bool   `json:"checkedArithmetic"`
+		HeapLimit   int64  `json:"heapLimit"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if s.machine != nil {
+		return nil, errors.New("A program has already been launched")
+	}
+	if args.Program == "" {
+		return nil, errors.New("No program given")
+	}
+
+	theLexer, err := lexer.New(args.Program)
+	if err != nil {
+		return nil, err
+	}
+	program, err := theLexer.Assemble()
+	if err != nil {
+		return nil, err
+	}
+	for _, diag := range theLexer.Diagnostics() {
+		s.output("stderr", diag.String()+"\n")
+	}
+
+	opts := []vm.Option{
+		vm.WithStdout(dapOutput{s, "stdout"}),
+		vm.WithStderr(dapOutput{s, "stderr"}),
+	}
+	if args.LegacyCalls {
+		opts = append(opts, vm.WithLegacyCalls())
+	}
+	if args.Checked {
+		opts = append(opts, vm.WithCheckedArithmetic())
+	}
+	if args.HeapLimit > 0 {
+		opts = append(opts, vm.WithHeapLimit(args.HeapLimit))
+	}
+
+	machine := vm.Load(program, opts...)
+	if err := hosts.Register(machine); err != nil {
+		return nil, err
+	}
+	if err := machine.Prepare(); err != nil {
+		return nil, err
+	}
+
+	s.machine = machine
+	s.d = newDebugger(machine)
+	s.d.onPause = s.onPaused
+	if !args.StopOnEntry {
+		s.d.mode = modeContinue
+	}
+	if program.Source != "" {
+		s.source, _ = filepath.Abs(program.Source)
+	}
+
+	// Breakpoints can only be mapped to addresses once the program is loaded
+	s.after = append(s.after, func() { s.event("initialized", nil) })
+	return nil, nil
+}
+
+func (s *DAP) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if s.d == nil {
+		return nil, errors.New("No program has been launched")
+	}
+
+	sameSource := true
+	if s.source != "" && args.Source.Path != "" {
+		path, _ := filepath.Abs(args.Source.Path)
+		sameSource = path == s.source
+	}
+
+	var bps []*breakpoint
+	result := []dapBreakpoint{}
+	for _, b := range args.Breakpoints {
+		addr, ok := s.d.lineAddr(b.Line)
+		if !sameSource || !ok {
+			result = append(result, dapBreakpoint{Line: b.Line, Message: "No code on or after this line"})
+			continue
+		}
+
+		bp := &breakpoint{id: s.d.nextID, addr: addr, desc: s.d.describe(addr)}
+		s.d.nextID++
+		bps = append(bps, bp)
+		result = append(result, dapBreakpoint{
+			ID:       bp.id,
+			Verified: true,
+			Line:     s.machine.Program().LineFor(addr),
+		})
+	}
+
+	s.d.mu.Lock()
+	s.d.breakpoints = bps
+	s.d.mu.Unlock()
+	return map[string]interface{}{"breakpoints": result}, nil
+}
+
+func (s *DAP) configurationDone(args json.RawMessage) (interface{}, error) {
+	if s.machine == nil {
+		return nil, errors.New("No program has been launched")
+	}
+	if !s.started {
+		s.started = true
+		s.after = append(s.after, s.run)
+	}
+	return nil, nil
+}
+
+func (s *DAP) run() {
+	go func() {
+		code, err := s.machine.Run(s.ctx)
+		if rerr, ok := err.(*vm.RuntimeError); err != nil && !(ok && rerr.Kind == vm.ErrCancelled) {
+			s.output("stderr", err.Error()+"\n")
+		}
+		s.event("exited", map[string]int{"exitCode": int(code)})
+		s.event("terminated", nil)
+		close(s.done)
+	}()
+}
+
+// onPaused is called on the VM's goroutine and waits until the client resumes
+// or stops the program
+func (s *DAP) onPaused(pc int64, reason string) {
+	body := map[string]interface{}{
+		"reason":            reason,
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	}
+	if reason == reasonBreakpoint {
+		if bp := s.d.breakpointAt(pc); bp != nil {
+			body["hitBreakpointIds"] = []int{bp.id}
+		}
+	}
+
+	atomic.StoreInt32(&s.paused, 1)
+	s.event("stopped", body)
+	select {
+	case <-s.resume:
+	case <-s.quit:
+	}
+}
+
+// checkPaused returns an error unless the program is waiting for the client
+func (s *DAP) checkPaused() error {
+	if atomic.LoadInt32(&s.paused) == 0 {
+		return errors.New("Program is not paused")
+	}
+	return nil
+}
+
+// resumeWith sets how to step and then continues the program once the
+// response has been sent
+func (s *DAP) resumeWith(step func()) error {
+	if err := s.checkPaused(); err != nil {
+		return err
+	}
+
+	step()
+	atomic.StoreInt32(&s.paused, 0)
+	s.after = append(s.after, func() { s.resume <- struct{}{} })
+	return nil
+}
+
+func (s *DAP) threads(args json.RawMessage) (interface{}, error) {
+	threads := []map[string]interface{}{{"id": dapThreadID, "name": "main"}}
+	return map[string]interface{}{"threads": threads}, nil
+}
+
+func (s *DAP) stackTrace(args json.RawMessage) (interface{}, error) {
+	if err := s.checkPaused(); err != nil {
+		return nil, err
+	}
+
+	p := s.machine.Program()
+	frame := func(id int, pc, entry int64) dapStackFrame {
+		f := dapStackFrame{
+			ID:             id,
+			Name:           s.d.function(entry),
+			Line:           p.LineFor(pc),
+			Column:         1,
+			InstructionPtr: fmt.Sprintf("0x%04X", pc),
+		}
+		if s.source != "" && f.Line > 0 {
+			f.Source = &dapSource{Name: filepath.Base(s.source), Path: s.source}
+		} else {
+			f.PresentationHint = "subtle"
+		}
+		return f
+	}
+
+	// Each frame holds the caller's return address
+	frames := s.machine.Frames()
+	pc := s.machine.PC()
+	result := []dapStackFrame{}
+	for i := len(frames) - 1; i >= 0; i-- {
+		result = append(result, frame(len(result), pc, frames[i].Entry))
+		pc = frames[i].Return
+	}
+
+	// Without a call stack the function is the nearest label
+	entry := p.Entry
+	if len(frames) == 0 {
+		if _, base, ok := s.d.nearestLabel(pc); ok {
+			entry = base
+		}
+	}
+	result = append(result, frame(len(result), pc, entry))
+
+	return map[string]interface{}{"stackFrames": result, "totalFrames": len(result)}, nil
+}
+
+func (s *DAP) scopes(args json.RawMessage) (interface{}, error) {
+	scopes := []map[string]interface{}{
+		{"name": "Registers", "variablesReference": dapRegisters, "expensive": false},
+		{"name": "Stack", "variablesReference": dapStack, "expensive": false},
+	}
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+func (s *DAP) variables(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := s.checkPaused(); err != nil {
+		return nil, err
+	}
+
+	vars := []dapVariable{}
+	switch args.VariablesReference {
+	case dapRegisters:
+		for reg := vm.A; reg <= vm.J; reg++ {
+			name, _ := lexer.RegisterName(reg)
+			val := s.machine.Register(reg)
+			vars = append(vars, dapVariable{Name: "$" + name, Value: val.String(), Type: val.Type.String()})
+		}
+		for _, reg := range []byte{vm.PC, vm.SP, vm.FP, vm.RT} {
+			name, _ := lexer.RegisterName(reg)
+			val := fmt.Sprintf("0x%X", s.machine.Register(reg).Int)
+			vars = append(vars, dapVariable{Name: "$" + name, Value: val, Type: "int"})
+		}
+		vars = append(vars, dapVariable{Name: "zero", Value: fmt.Sprint(s.machine.ZeroFlag()), Type: "int"})
+	case dapStack:
+		for i := int64(0); i < s.machine.StackDepth(); i++ {
+			val, _ := s.machine.StackValue(i)
+			vars = append(vars, dapVariable{Name: fmt.Sprintf("[%d]", i), Value: val.String(), Type: val.Type.String()})
+		}
+	default:
+		return nil, fmt.Errorf("Unknown variables reference %d", args.VariablesReference)
+	}
+	return map[string]interface{}{"variables": vars}, nil
+}
+
+func (s *DAP) continueRequest(args json.RawMessage) (interface{}, error) {
+	err := s.resumeWith(func() { s.d.mode = modeContinue })
+	if err != nil {
+		return nil, err
+	}
+	return map[string]bool{"allThreadsContinued": true}, nil
+}
+
+func (s *DAP) next(args json.RawMessage) (interface{}, error) {
+	return nil, s.resumeWith(s.d.stepOver)
+}
+
+func (s *DAP) stepIn(args json.RawMessage) (interface{}, error) {
+	return nil, s.resumeWith(func() { s.d.mode = modeStep })
+}
+
+func (s *DAP) stepOut(args json.RawMessage) (interface{}, error) {
+	return nil, s.resumeWith(s.d.stepOut)
+}
+
+func (s *DAP) pause(args json.RawMessage) (interface{}, error) {
+	if s.d == nil {
+		return nil, errors.New("No program has been launched")
+	}
+	if atomic.LoadInt32(&s.paused) == 0 {
+		atomic.StoreInt32(&s.d.pauseRequested, 1)
+	}
+	return nil, nil
+}
+
+func (s *DAP) terminate(args json.RawMessage) (interface{}, error) {
+	s.stop()
+	return nil, nil
+}
+
+// stop ends the program and waits for it to finish
+func (s *DAP) stop() {
+	if !s.started {
+		return
+	}
+
+	select {
+	case <-s.quit:
+	default:
+		atomic.StoreInt32(&s.d.stopRequested, 1)
+		close(s.quit)
+	}
+	<-s.done
+}
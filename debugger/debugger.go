@@ -0,0 +1,625 @@
+// Package debugger is an interactive command line debugger for the VM.
+package debugger
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elemental-vm/test-vm/lexer"
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+type mode uint8
+
+const (
+	modeContinue mode = iota // Run until a breakpoint
+	modeStep                 // Pause before the next instruction
+	modeOver                 // Pause once a CALL returns
+	modeOut                  // Pause once the current function returns
+)
+
+type breakpoint struct {
+	id   int
+	addr int64
+	desc string
+}
+
+// Debugger pauses a VM before instructions to let the user inspect and
+// change the machine.
+type Debugger struct {
+	vm     *vm.VM
+	in     *bufio.Reader
+	out    io.Writer
+	source []string // Lines of the program's source, if it can be read
+
+	mu          sync.Mutex // Guards breakpoints when they're changed while running
+	breakpoints []*breakpoint
+	nextID      int
+
+	mode   mode
+	depth  int   // Call depth when stepping over or out began
+	target int64 // Address to pause at when stepping over or out
+
+	// Set from other goroutines to pause or stop the running program
+	pauseRequested int32
+	stopRequested  int32
+
+	// Called when execution pauses, it returns when execution should continue
+	onPause func(pc int64, reason string)
+
+	started bool // Set once the first instruction is reached
+	lastCmd string
+}
+
+// Reasons execution paused
+const (
+	reasonEntry      = "entry"
+	reasonStep       = "step"
+	reasonBreakpoint = "breakpoint"
+	reasonPause      = "pause"
+)
+
+// New attaches a debugger to a VM. Commands are read from in and the
+// debugger's output is written to out.
+func New(machine *vm.VM, in io.Reader, out io.Writer) *Debugger {
+	d := newDebugger(machine)
+	d.in = bufio.NewReader(in)
+	d.out = out
+	d.onPause = d.prompt
+	return d
+}
+
+func newDebugger(machine *vm.VM) *Debugger {
+	d := &Debugger{
+		vm:     machine,
+		nextID: 1,
+		mode:   modeStep,
+	}
+
+	machine.AddHook(d.hook)
+	machine.OnStep(func(*vm.VM) {
+		d.mode = modeStep
+	})
+	return d
+}
+
+// Run executes the program, pausing before the first instruction
+func (d *Debugger) Run(ctx context.Context) (byte, error) {
+	if err := d.vm.Prepare(); err != nil {
+		return 1, err
+	}
+
+	p := d.vm.Program()
+	if p.Source != "" {
+		if src, err := ioutil.ReadFile(p.Source); err == nil {
+			d.source = strings.Split(string(src), "\n")
+		}
+	}
+
+	fmt.Fprintln(d.out, `Type "help" for a list of commands`)
+	return d.vm.Run(ctx)
+}
+
+func (d *Debugger) hook(machine *vm.VM) {
+	if atomic.LoadInt32(&d.stopRequested) != 0 {
+		machine.Stop()
+		return
+	}
+
+	pc := machine.PC()
+
+	reason := ""
+	switch d.mode {
+	case modeStep:
+		reason = reasonStep
+	case modeOver:
+		depth := machine.CallDepth()
+		if (pc == d.target && depth <= d.depth) || depth < d.depth {
+			reason = reasonStep
+		}
+	case modeOut:
+		depth := machine.CallDepth()
+		if (d.depth > 0 && depth < d.depth) || (d.depth == 0 && pc == d.target) {
+			reason = reasonStep
+		}
+	}
+
+	if !d.started {
+		d.started = true
+		if reason != "" {
+			reason = reasonEntry
+		}
+	}
+
+	if d.breakpointAt(pc) != nil {
+		reason = reasonBreakpoint
+	}
+
+	if atomic.CompareAndSwapInt32(&d.pauseRequested, 1, 0) {
+		reason = reasonPause
+	}
+
+	if reason != "" {
+		d.mode = modeContinue
+		d.onPause(pc, reason)
+		if atomic.LoadInt32(&d.stopRequested) != 0 {
+			machine.Stop()
+		}
+	}
+}
+
+func (d *Debugger) breakpointAt(pc int64) *breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, bp := range d.breakpoints {
+		if bp.addr == pc {
+			return bp
+		}
+	}
+	return nil
+}
+
+// prompt reads commands until one resumes execution
+func (d *Debugger) prompt(pc int64, reason string) {
+	if reason == reasonBreakpoint {
+		bp := d.breakpointAt(pc)
+		fmt.Fprintf(d.out, "Breakpoint %d, %s\n", bp.id, bp.desc)
+	}
+	d.showLocation(pc)
+
+	for {
+		fmt.Fprint(d.out, "(debug) ")
+		line, err := d.in.ReadString('\n')
+		if err != nil && line == "" {
+			// Nothing more can be read so let the program finish
+			fmt.Fprintln(d.out)
+			d.breakpoints = nil
+			d.mode = modeContinue
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = d.lastCmd
+		}
+		if line == "" {
+			continue
+		}
+		d.lastCmd = line
+
+		fields := strings.Fields(line)
+		cmd, ok := commands[fields[0]]
+		if !ok {
+			fmt.Fprintf(d.out, "Unknown command %s\n", fields[0])
+			continue
+		}
+
+		if cmd.fn(d, fields[1:]) {
+			return
+		}
+	}
+}
+
+type command struct {
+	fn   func(d *Debugger, args []string) bool // Returns true to resume execution
+	help string
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"break":     {(*Debugger).cmdBreak, "break <label|0xaddr|line>  Set a breakpoint"},
+		"delete":    {(*Debugger).cmdDelete, "delete [n]                 Delete breakpoint n or all breakpoints"},
+		"info":      {(*Debugger).cmdInfo, "info                       List breakpoints"},
+		"continue":  {(*Debugger).cmdContinue, "continue                   Run until a breakpoint"},
+		"step":      {(*Debugger).cmdStep, "step                       Execute one instruction, entering calls"},
+		"next":      {(*Debugger).cmdNext, "next                       Execute one instruction, stepping over calls"},
+		"finish":    {(*Debugger).cmdFinish, "finish                     Run until the current function returns to $RT"},
+		"print":     {(*Debugger).cmdPrint, "print <$reg|n>             Print a register or stack slot n, 0 being TOS"},
+		"set":       {(*Debugger).cmdSet, "set <$reg> <value>         Set a register to a number or quoted string"},
+		"registers": {(*Debugger).cmdRegisters, "registers                  Print all registers"},
+		"stack":     {(*Debugger).cmdStack, "stack                      Print the stack"},
+		"backtrace": {(*Debugger).cmdBacktrace, "backtrace                  Print the call stack"},
+		"list":      {(*Debugger).cmdList, "list [n]                   Print the next n instructions"},
+		"quit":      {(*Debugger).cmdQuit, "quit                       Stop the program"},
+		"help":      {(*Debugger).cmdHelp, "help                       Print this message"},
+	}
+
+	aliases := map[string]string{
+		"b":  "break",
+		"d":  "delete",
+		"c":  "continue",
+		"s":  "step",
+		"n":  "next",
+		"f":  "finish",
+		"p":  "print",
+		"r":  "registers",
+		"bt": "backtrace",
+		"l":  "list",
+		"q":  "quit",
+		"h":  "help",
+	}
+	for alias, name := range aliases {
+		commands[alias] = commands[name]
+	}
+}
+
+func (d *Debugger) cmdBreak(args []string) bool {
+	if len(args) != 1 {
+		fmt.Fprintln(d.out, "Usage: break <label|0xaddr|line>")
+		return false
+	}
+
+	addr, desc, err := d.resolve(args[0])
+	if err != nil {
+		fmt.Fprintln(d.out, err.Error())
+		return false
+	}
+	if !d.vm.IsInstruction(addr) {
+		fmt.Fprintf(d.out, "0x%X is not the start of an instruction\n", addr)
+		return false
+	}
+
+	bp := &breakpoint{id: d.nextID, addr: addr, desc: desc}
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, bp)
+	fmt.Fprintf(d.out, "Breakpoint %d at %s\n", bp.id, bp.desc)
+	return false
+}
+
+// resolve finds the address of a label, address or source line
+func (d *Debugger) resolve(loc string) (int64, string, error) {
+	p := d.vm.Program()
+
+	if strings.HasPrefix(loc, "0x") {
+		addr, err := strconv.ParseInt(loc[2:], 16, 64)
+		if err != nil {
+			return 0, "", fmt.Errorf("Invalid address %s", loc)
+		}
+		return addr, d.describe(addr), nil
+	}
+
+	// A line may be given as file:line
+	lineStr := loc
+	if i := strings.LastIndexByte(loc, ':'); i >= 0 {
+		lineStr = loc[i+1:]
+	}
+	if line, err := strconv.Atoi(lineStr); err == nil {
+		addr, ok := d.lineAddr(line)
+		if !ok {
+			return 0, "", fmt.Errorf("No code on or after line %d", line)
+		}
+		return addr, d.describe(addr), nil
+	}
+
+	addr, ok := p.Symbols[strings.TrimPrefix(loc, "%")]
+	if !ok {
+		return 0, "", fmt.Errorf("No label named %s", loc)
+	}
+	return addr, d.describe(addr), nil
+}
+
+// lineAddr returns the address of the first instruction on or after a source line
+func (d *Debugger) lineAddr(line int) (int64, bool) {
+	p := d.vm.Program()
+	best := -1
+	for i, entry := range p.Lines {
+		if entry.Line >= line && (best == -1 || entry.Line < p.Lines[best].Line) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	return p.Lines[best].Addr, true
+}
+
+func (d *Debugger) cmdDelete(args []string) bool {
+	if len(args) == 0 {
+		d.breakpoints = nil
+		fmt.Fprintln(d.out, "Deleted all breakpoints")
+		return false
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintln(d.out, "Usage: delete [n]")
+		return false
+	}
+
+	for i, bp := range d.breakpoints {
+		if bp.id == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			fmt.Fprintf(d.out, "Deleted breakpoint %d\n", id)
+			return false
+		}
+	}
+	fmt.Fprintf(d.out, "No breakpoint %d\n", id)
+	return false
+}
+
+func (d *Debugger) cmdInfo(args []string) bool {
+	if len(d.breakpoints) == 0 {
+		fmt.Fprintln(d.out, "No breakpoints")
+		return false
+	}
+
+	for _, bp := range d.breakpoints {
+		fmt.Fprintf(d.out, "%d: %s\n", bp.id, bp.desc)
+	}
+	return false
+}
+
+func (d *Debugger) cmdContinue(args []string) bool {
+	d.mode = modeContinue
+	return true
+}
+
+func (d *Debugger) cmdStep(args []string) bool {
+	d.mode = modeStep
+	return true
+}
+
+func (d *Debugger) cmdNext(args []string) bool {
+	d.stepOver()
+	return true
+}
+
+func (d *Debugger) cmdFinish(args []string) bool {
+	d.stepOut()
+	return true
+}
+
+// stepOver steps to the next instruction, running a CALL until it returns
+func (d *Debugger) stepOver() {
+	pc := d.vm.PC()
+	inst, err := d.vm.Program().Decode(pc)
+	if err != nil || inst.Opcode != vm.Call {
+		d.mode = modeStep
+		return
+	}
+
+	d.mode = modeOver
+	d.depth = d.vm.CallDepth()
+	d.target = pc + inst.Size
+}
+
+// stepOut runs until the current function returns
+func (d *Debugger) stepOut() {
+	d.mode = modeOut
+	d.depth = d.vm.CallDepth()
+	d.target = d.vm.Register(vm.RT).Int
+}
+
+func (d *Debugger) cmdPrint(args []string) bool {
+	if len(args) == 0 {
+		args = []string{"0"}
+	}
+
+	for _, arg := range args {
+		if reg, ok := lexer.Register(arg); ok {
+			name, _ := lexer.RegisterName(reg)
+			fmt.Fprintf(d.out, "$%s = %s\n", name, d.vm.Register(reg))
+			continue
+		}
+
+		slot, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			fmt.Fprintf(d.out, "%s is not a register or stack slot\n", arg)
+			continue
+		}
+
+		val, ok := d.vm.StackValue(slot)
+		if !ok {
+			fmt.Fprintf(d.out, "Stack slot %d is empty\n", slot)
+			continue
+		}
+		fmt.Fprintf(d.out, "[%d] = %s\n", slot, val)
+	}
+	return false
+}
+
+func (d *Debugger) cmdSet(args []string) bool {
+	if len(args) < 2 {
+		fmt.Fprintln(d.out, "Usage: set <$reg> <value>")
+		return false
+	}
+
+	reg, ok := lexer.Register(args[0])
+	if !ok {
+		fmt.Fprintf(d.out, "%s is not a register\n", args[0])
+		return false
+	}
+
+	text := strings.Join(args[1:], " ")
+	var val vm.Value
+	if text[0] == '"' {
+		if len(text) < 2 || text[len(text)-1] != '"' {
+			fmt.Fprintln(d.out, "Unterminated string")
+			return false
+		}
+		val = vm.Str(text[1 : len(text)-1])
+	} else if i, err := strconv.ParseInt(text, 0, 64); err == nil {
+		val = vm.Int(i)
+	} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+		val = vm.Float(f)
+	} else {
+		fmt.Fprintf(d.out, "Invalid value %s\n", text)
+		return false
+	}
+
+	if err := d.vm.SetRegister(reg, val); err != nil {
+		fmt.Fprintf(d.out, "Can't set %s: %s\n", args[0], err)
+	}
+	return false
+}
+
+func (d *Debugger) cmdRegisters(args []string) bool {
+	for _, reg := range []byte{vm.PC, vm.SP, vm.FP, vm.RT} {
+		name, _ := lexer.RegisterName(reg)
+		fmt.Fprintf(d.out, "$%-2s = 0x%X\n", name, d.vm.Register(reg).Int)
+	}
+	for reg := vm.A; reg <= vm.J; reg++ {
+		name, _ := lexer.RegisterName(reg)
+		fmt.Fprintf(d.out, "$%-2s = %s\n", name, d.vm.Register(reg))
+	}
+	fmt.Fprintf(d.out, "zero = %d\n", d.vm.ZeroFlag())
+	return false
+}
+
+func (d *Debugger) cmdStack(args []string) bool {
+	depth := d.vm.StackDepth()
+	if depth == 0 {
+		fmt.Fprintln(d.out, "Stack is empty")
+		return false
+	}
+
+	fp := d.vm.Register(vm.FP).Int
+	for i := int64(0); i < depth; i++ {
+		val, _ := d.vm.StackValue(i)
+		marker := ""
+		if depth-1-i == fp-1 {
+			marker = "  <- PARAM 1"
+		}
+		fmt.Fprintf(d.out, "[%d] %s%s\n", i, val, marker)
+	}
+	return false
+}
+
+func (d *Debugger) cmdBacktrace(args []string) bool {
+	frames := d.vm.Frames()
+	pc := d.vm.PC()
+	fp := d.vm.Register(vm.FP).Int
+
+	if len(frames) == 0 {
+		fmt.Fprintf(d.out, "#0 %s fp=0x%X\n", d.describe(pc), fp)
+		if rt := d.vm.Register(vm.RT).Int; rt != 0 {
+			fmt.Fprintf(d.out, "#1 %s ($RT)\n", d.describe(rt))
+		}
+		return false
+	}
+
+	// Each frame holds the caller's return address and frame pointer
+	for i := len(frames) - 1; i >= 0; i-- {
+		fmt.Fprintf(d.out, "#%d %s in %s fp=0x%X\n", len(frames)-1-i, d.describe(pc), d.function(frames[i].Entry), fp)
+		pc = frames[i].Return
+		fp = frames[i].FP
+	}
+	fmt.Fprintf(d.out, "#%d %s fp=0x%X\n", len(frames), d.describe(pc), fp)
+	return false
+}
+
+func (d *Debugger) cmdList(args []string) bool {
+	count := 5
+	if len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil && n > 0 {
+			count = n
+		}
+	}
+
+	p := d.vm.Program()
+	addr := d.vm.PC()
+	for i := 0; i < count; i++ {
+		inst, err := p.Decode(addr)
+		if err != nil {
+			break
+		}
+
+		marker := "  "
+		if i == 0 {
+			marker = "=>"
+		}
+		fmt.Fprintf(d.out, "%s 0x%04X  %s\n", marker, addr, lexer.FormatInstruction(p, inst))
+		addr += inst.Size
+	}
+	return false
+}
+
+func (d *Debugger) cmdQuit(args []string) bool {
+	d.vm.Stop()
+	return true
+}
+
+func (d *Debugger) cmdHelp(args []string) bool {
+	var lines []string
+	for name, cmd := range commands {
+		if strings.HasPrefix(cmd.help, name+" ") {
+			lines = append(lines, cmd.help)
+		}
+	}
+	sort.Strings(lines)
+
+	for _, line := range lines {
+		fmt.Fprintln(d.out, line)
+	}
+	fmt.Fprintln(d.out, "An empty line repeats the last command")
+	return false
+}
+
+// showLocation prints the instruction about to execute and its source line
+func (d *Debugger) showLocation(pc int64) {
+	p := d.vm.Program()
+	inst, err := p.Decode(pc)
+	if err != nil {
+		fmt.Fprintf(d.out, "%s: %s\n", d.describe(pc), err)
+		return
+	}
+
+	fmt.Fprintf(d.out, "%s  %s\n", d.describe(pc), lexer.FormatInstruction(p, inst))
+
+	line := p.LineFor(pc)
+	if line > 0 && line <= len(d.source) {
+		fmt.Fprintf(d.out, "%4d  %s\n", line, strings.TrimSpace(d.source[line-1]))
+	}
+}
+
+// describe returns an address with the nearest label before it and its source line
+func (d *Debugger) describe(addr int64) string {
+	p := d.vm.Program()
+	desc := fmt.Sprintf("0x%04X", addr)
+
+	if label, base, ok := d.nearestLabel(addr); ok {
+		if addr == base {
+			desc += " <" + label + ">"
+		} else {
+			desc += fmt.Sprintf(" <%s+0x%X>", label, addr-base)
+		}
+	}
+
+	if line := p.LineFor(addr); line > 0 {
+		desc += fmt.Sprintf(" (%s:%d)", p.Source, line)
+	}
+	return desc
+}
+
+// function returns the name of the function at addr
+func (d *Debugger) function(addr int64) string {
+	if label, base, ok := d.nearestLabel(addr); ok && base == addr {
+		return label
+	}
+	return fmt.Sprintf("0x%04X", addr)
+}
+
+func (d *Debugger) nearestLabel(addr int64) (string, int64, bool) {
+	best := ""
+	bestAddr := int64(-1)
+	for name, labelAddr := range d.vm.Program().Symbols {
+		if labelAddr > addr || labelAddr < bestAddr {
+			continue
+		}
+		if labelAddr > bestAddr || name < best {
+			best = name
+			bestAddr = labelAddr
+		}
+	}
+	return best, bestAddr, bestAddr >= 0
+}
@@ -0,0 +1,80 @@
+// Package hosts has the host functions testvm makes available to every program.
+package hosts
+
+import (
+	"fmt"
+
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+// Register makes the host functions callable by the program a VM runs
+func Register(machine *vm.VM) error {
+	funcs := []struct {
+		name  string
+		arity int
+		fn    vm.HostFunc
+	}{
+		{"max", 2, pick("max", 1)},
+		{"min", 2, pick("min", -1)},
+	}
+
+	for _, f := range funcs {
+		if _, err := machine.RegisterHost(f.name, f.arity, f.fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pick returns a host function which returns the first of two numbers if
+// comparing it to the second gives want, otherwise the second
+func pick(name string, want int) vm.HostFunc {
+	return func(machine *vm.VM, args []vm.Value) ([]vm.Value, error) {
+		c, ok := compare(args[0], args[1])
+		if !ok {
+			return nil, fmt.Errorf("%s only works on numbers", name)
+		}
+
+		if c == want {
+			return args[:1], nil
+		}
+		return args[1:], nil
+	}
+}
+
+// compare returns -1, 0 or 1 as a is less than, equal to or greater than b.
+// Two integers are compared exactly, otherwise both are used as floats.
+func compare(a, b vm.Value) (int, bool) {
+	if a.Type == vm.TypeInt && b.Type == vm.TypeInt {
+		switch {
+		case a.Int < b.Int:
+			return -1, true
+		case a.Int > b.Int:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	x, ok1 := number(a)
+	y, ok2 := number(b)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+func number(v vm.Value) (float64, bool) {
+	switch v.Type {
+	case vm.TypeInt:
+		return float64(v.Int), true
+	case vm.TypeFloat:
+		return v.Float, true
+	}
+	return 0, false
+}
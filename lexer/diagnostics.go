@@ -0,0 +1,85 @@
+package lexer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity is how serious a Diagnostic is
+type Severity uint8
+
+const (
+	// SeverityError prevents the program from being assembled
+	SeverityError Severity = iota
+	// SeverityWarning is reported but the program is still assembled
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a problem found in the source while assembling
+type Diagnostic struct {
+	Source   string
+	Line     int
+	Column   int
+	Severity Severity
+	Msg      string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.Source, d.Line, d.Column, d.Severity, d.Msg)
+}
+
+// Diagnostics is every problem found while assembling. It's returned as the
+// error from Parse when at least one of them is an error.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	lines := make([]string, len(d))
+	for i, diag := range d {
+		lines[i] = diag.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (d *Diagnostics) add(source string, line, col int, sev Severity, msg string) {
+	*d = append(*d, Diagnostic{
+		Source:   source,
+		Line:     line,
+		Column:   col,
+		Severity: sev,
+		Msg:      msg,
+	})
+}
+
+func (d Diagnostics) hasErrors() bool {
+	for _, diag := range d {
+		if diag.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+func (d Diagnostics) sort() {
+	sort.SliceStable(d, func(i, j int) bool {
+		if d[i].Line != d[j].Line {
+			return d[i].Line < d[j].Line
+		}
+		return d[i].Column < d[j].Column
+	})
+}
+
+func (l *Lexer) errorf(tok token, format string, a ...interface{}) {
+	l.diags.add(l.name, l.line, tok.col, SeverityError, fmt.Sprintf(format, a...))
+}
+
+func (l *Lexer) warnf(tok token, format string, a ...interface{}) {
+	l.diags.add(l.name, l.line, tok.col, SeverityWarning, fmt.Sprintf(format, a...))
+}
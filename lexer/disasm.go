@@ -0,0 +1,147 @@
+package lexer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+// Disassemble writes the program as assembly source. Labels from the symbol
+// table are used where available and generated for any other jump or call
+// targets. Each instruction is commented with its address.
+func Disassemble(w io.Writer, p *vm.Program) error {
+	labels, hosts := symbolNames(p)
+
+	// Decode everything first so jump targets can be labelled
+	var insts []vm.Instruction
+	for addr := int64(0); addr < int64(len(p.Code)); {
+		inst, err := p.Decode(addr)
+		if err != nil {
+			inst = vm.Instruction{Addr: addr, Opcode: p.Code[addr], Size: 1}
+		}
+		insts = append(insts, inst)
+		addr += inst.Size
+
+		for _, op := range inst.Operands {
+			if op.Kind == vm.OperandAddr {
+				if _, ok := labels[op.Int]; !ok {
+					labels[op.Int] = fmt.Sprintf("L_%04X", op.Int)
+				}
+			}
+		}
+	}
+
+	if p.Source != "" {
+		fmt.Fprintf(w, ";; Disassembled from %s\n", p.Source)
+	}
+	if p.ISAVersion != vm.ISAVersion {
+		fmt.Fprintf(w, ";; Instruction set version %d, addresses will change when upgraded\n", p.ISAVersion)
+	}
+	if p.Entry != 0 {
+		if _, ok := p.Symbols["main"]; !ok {
+			fmt.Fprintf(w, ";; Entry address 0x%04X\n", p.Entry)
+		}
+	}
+
+	// Labels beyond the end of the code would otherwise be lost
+	var trailing []int64
+	for addr := range labels {
+		if addr >= int64(len(p.Code)) {
+			trailing = append(trailing, addr)
+		}
+	}
+	sort.Slice(trailing, func(i, j int) bool { return trailing[i] < trailing[j] })
+
+	for _, inst := range insts {
+		if label, ok := labels[inst.Addr]; ok {
+			fmt.Fprintf(w, "%s:\n", label)
+		}
+
+		if inst.Name == "" {
+			fmt.Fprintf(w, "    %-32s; 0x%04X\n", fmt.Sprintf(";; unknown bytecode 0x%02X", inst.Opcode), inst.Addr)
+			continue
+		}
+
+		text, _ := Mnemonic(inst.Opcode)
+		for _, op := range inst.Operands {
+			text += " " + formatOperand(op, labels, hosts)
+		}
+		fmt.Fprintf(w, "    %-32s; 0x%04X\n", text, inst.Addr)
+	}
+
+	for _, addr := range trailing {
+		fmt.Fprintf(w, "%s:\n", labels[addr])
+	}
+
+	return nil
+}
+
+// FormatInstruction returns an instruction as assembly. Addresses are shown
+// as labels when the program's symbol table has one for them.
+func FormatInstruction(p *vm.Program, inst vm.Instruction) string {
+	text, ok := Mnemonic(inst.Opcode)
+	if !ok {
+		return fmt.Sprintf(";; unknown bytecode 0x%02X", inst.Opcode)
+	}
+
+	labels, hosts := symbolNames(p)
+
+	for _, op := range inst.Operands {
+		if op.Kind == vm.OperandAddr {
+			if _, ok := labels[op.Int]; !ok {
+				text += fmt.Sprintf(" 0x%X", op.Int)
+				continue
+			}
+		}
+		text += " " + formatOperand(op, labels, hosts)
+	}
+	return text
+}
+
+// symbolNames returns the label for each address in the symbol table and the
+// name of each host function in the constant pool
+func symbolNames(p *vm.Program) (map[int64]string, map[int64]string) {
+	labels := make(map[int64]string, len(p.Symbols))
+	for name, addr := range p.Symbols {
+		// Keep output stable when several labels share an address
+		if existing, ok := labels[addr]; !ok || name < existing {
+			labels[addr] = name
+		}
+	}
+
+	hosts := make(map[int64]string, len(p.Constants))
+	for _, c := range p.Constants {
+		hosts[vm.HostID(string(c))] = string(c)
+	}
+	return labels, hosts
+}
+
+func formatOperand(op vm.Operand, labels map[int64]string, hosts map[int64]string) string {
+	switch op.Kind {
+	case vm.OperandReg:
+		if name, ok := RegisterName(byte(op.Int)); ok {
+			return "$" + name
+		}
+		return fmt.Sprintf("$0x%X", op.Int)
+	case vm.OperandStr:
+		return `"` + string(op.Str) + `"`
+	case vm.OperandFloat:
+		return vm.Float(op.Float).String()
+	case vm.OperandAddr:
+		return "%" + labels[op.Int]
+	case vm.OperandIntOrAddr:
+		// The value may only look like an address but the bytecode is the same either
+		// way. Zero is almost always meant as a number so it's left alone.
+		if label, ok := labels[op.Int]; ok && op.Int != 0 {
+			return "%" + label
+		}
+	case vm.OperandHost:
+		if name, ok := hosts[op.Int]; ok {
+			return `"` + name + `"`
+		}
+	}
+	return strconv.FormatInt(op.Int, 10)
+}
@@ -5,27 +5,31 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"strings"
 
-	"bytes"
-
 	"io/ioutil"
 
 	"github.com/elemental-vm/test-vm/vm"
 )
 
-var FileHeader = []byte{31, 'E', 'B', 'C'}
+// FileHeader is the magic at the start of compiled bytecode files
+var FileHeader = vm.FileMagic
 
 type sub struct {
 	pos   int64
 	label string
+
+	line int // Location of the reference for error messages
+	col  int
 }
 
 type Lexer struct {
+	name   string // Source name used in error messages
 	r      *bufio.Reader
-	file   *os.File
+	file   io.Closer // Closed once parsing is done, may be nil
 	simple bool
 
 	line int
@@ -35,31 +39,77 @@ type Lexer struct {
 
 	labels    map[string]int64
 	labelSubs []*sub
+
+	reachable bool // False after an unconditional jump until the next label
+	diags     Diagnostics
+
+	lines     []vm.LineEntry
+	constants [][]byte
+	constIdx  map[string]int
 }
 
+// New opens a file which can be either assembly source or a compiled bytecode
+// file. Compiled files are detected by their header.
 func New(file string) (*Lexer, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 
-	l := &Lexer{}
-
-	header := make([]byte, 4)
-	f.Read(header)
-	if bytes.Equal(header, FileHeader) {
-		l.simple = true
-		l.file = f
-		return l, nil
+	r := bufio.NewReader(f)
+	header, _ := r.Peek(len(FileHeader))
+	if vm.IsCompiled(header) {
+		return &Lexer{
+			name:   file,
+			r:      r,
+			file:   f,
+			simple: true,
+		}, nil
 	}
 
-	f.Seek(0, 0) // Reset reader
-	l.r = bufio.NewReader(f)
-	l.labels = make(map[string]int64)
-	l.labelSubs = make([]*sub, 0, 15)
+	l := NewReader(file, r)
+	l.file = f
 	return l, nil
 }
 
+// NewReader creates a Lexer for assembly source read from r. name is used
+// to identify the source in error messages.
+func NewReader(name string, r io.Reader) *Lexer {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &Lexer{
+		name:      name,
+		r:         br,
+		labels:    make(map[string]int64),
+		labelSubs: make([]*sub, 0, 15),
+		reachable: true,
+		constIdx:  make(map[string]int),
+	}
+}
+
+// NewString creates a Lexer for assembly source held in memory
+func NewString(name, src string) *Lexer {
+	return NewReader(name, strings.NewReader(src))
+}
+
+// LoadBytecode reads a compiled bytecode file from r. Both the current and
+// legacy file formats are accepted.
+func LoadBytecode(r io.Reader) (*vm.Program, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return vm.ReadProgram(data)
+}
+
+// Name returns the name of the source being parsed
+func (l *Lexer) Name() string {
+	return l.name
+}
+
 func (l *Lexer) addToProgram(bit byte) {
 	l.pc++
 	l.program = append(l.program, bit)
@@ -71,19 +121,36 @@ func (l *Lexer) addSliceToProgram(bytes []byte) {
 	}
 }
 
-func (l *Lexer) addLabelSub(label string) {
+func (l *Lexer) addLabelSub(tok token) {
 	l.labelSubs = append(l.labelSubs, &sub{
 		pos:   l.pc,
-		label: label,
+		label: tok.text[1:],
+		line:  l.line,
+		col:   tok.col,
 	})
 }
 
+// Parse assembles the source and returns only the bytecode. See Assemble.
 func (l *Lexer) Parse() ([]byte, error) {
+	p, err := l.Assemble()
+	if err != nil {
+		return nil, err
+	}
+	return p.Code, nil
+}
+
+// Assemble assembles the source into a Program, or loads the Program if the
+// Lexer was created from a compiled file. Assembly continues after errors
+// so all problems are reported at once as Diagnostics.
+func (l *Lexer) Assemble() (*vm.Program, error) {
+	if l.file != nil {
+		defer l.file.Close()
+	}
+
 	if l.simple {
-		program, err := ioutil.ReadAll(l.file)
-		l.file.Close()
+		program, err := LoadBytecode(l.r)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %s", l.name, err)
 		}
 		return program, nil
 	}
@@ -99,373 +166,442 @@ func (l *Lexer) Parse() ([]byte, error) {
 		line, err := l.r.ReadString('\n')
 		if err != nil {
 			if err != io.EOF {
-				return nil, err
+				return nil, fmt.Errorf("%s: %s", l.name, err)
 			}
 			quit = true
 		}
 		l.line++
 
-		line = strings.TrimSpace(line)
-		if line == "" || line[0] == ';' {
-			continue
-		}
+		l.parseLine(strings.TrimRight(line, "\r\n"))
+	}
 
-		text := strings.SplitN(line, ";", 2)
-		line = strings.TrimSpace(text[0])
+	l.subLabels()
 
-		lineLabel := strings.SplitN(line, ":", 2)
-		if len(lineLabel) == 2 {
-			l.labels[lineLabel[0]] = l.pc
-			line = strings.TrimSpace(lineLabel[1])
-		}
+	if l.diags.hasErrors() {
+		l.diags.sort()
+		return nil, l.diags
+	}
 
-		if line == "" {
-			continue
-		}
+	p := vm.NewProgram(l.program)
+	p.Entry = l.labels["main"]
+	p.Constants = l.constants
+	p.Symbols = l.labels
+	p.Source = l.name
+	p.Lines = l.lines
+	for _, sub := range l.labelSubs {
+		p.Relocs = append(p.Relocs, sub.pos)
+	}
+	return p, nil
+}
 
-		structure := strings.Split(line, " ")
-		parts := len(structure)
-		if parts == 0 {
-			continue
-		}
+// AssembleLine assembles one more line of source and returns its bytecode.
+// Labels defined on earlier lines can be used but not labels defined later.
+// If the line has errors they're returned and the Lexer is left as it was.
+func (l *Lexer) AssembleLine(text string) ([]byte, error) {
+	pc := l.pc
+	reachable := l.reachable
+	subs := len(l.labelSubs)
+	lines := len(l.lines)
+	consts := len(l.constants)
+	diags := len(l.diags)
 
-		bytecode, ok := bytecodes[strings.ToUpper(structure[0])]
-		if !ok {
-			return nil, fmt.Errorf("Unknown instruction %s on line %d", structure[0], l.line)
-		}
-		l.addToProgram(bytecode)
-
-		switch bytecode {
-		case vm.Halt:
-			err = l.parseParamOneByte(structure)
-		case vm.PushI:
-			err = l.parseParamOneInt(structure)
-		case vm.PushReg:
-			err = l.parseParamOneRegister(structure)
-		case vm.PrintR:
-			err = l.parseParamOneRegister(structure)
-		case vm.PopReg:
-			err = l.parseParamOneRegister(structure)
-		case vm.Store:
-			err = l.parseParamOneRegister(structure)
-		case vm.SetI:
-			err = l.parseParamsRegIntOrLabel(structure)
-		case vm.Jump:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.JumpGtz:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.JumpLtz:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.JumpEq:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.JumpNeq:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.Call:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.PushStr:
-			err = l.parseParamOneString(structure)
-		case vm.SetStr:
-			err = l.parseParamsRegString(structure)
-		case vm.Param:
-			err = l.parseParamsRegInt(structure)
-		case vm.JumpReg:
-			err = l.parseParamOneRegister(structure)
-		case vm.Compare:
-			err = l.parseParamsTwoRegisters(structure)
-		case vm.JumpZGtz:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.JumpZLtz:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.JumpZEq:
-			err = l.parseParamOneIntOrLabel(structure)
-		case vm.JumpZNeq:
-			err = l.parseParamOneIntOrLabel(structure)
-		default:
-			err = nil
-		}
+	labels := make(map[string]bool, len(l.labels))
+	for name := range l.labels {
+		labels[name] = true
+	}
 
-		if err != nil {
-			return nil, err
+	l.line++
+	l.parseLine(strings.TrimRight(text, "\r\n"))
+	for _, sub := range l.labelSubs[subs:] {
+		l.subLabel(sub)
+	}
+
+	var errs Diagnostics
+	for _, diag := range l.diags[diags:] {
+		if diag.Severity == SeverityError {
+			errs = append(errs, diag)
 		}
 	}
+	l.diags = l.diags[:diags]
 
-	if err := l.subLabels(); err != nil {
-		return nil, err
+	if len(errs) > 0 {
+		l.pc = pc
+		l.program = l.program[:pc]
+		l.reachable = reachable
+		l.labelSubs = l.labelSubs[:subs]
+		l.lines = l.lines[:lines]
+		for _, c := range l.constants[consts:] {
+			delete(l.constIdx, string(c))
+		}
+		l.constants = l.constants[:consts]
+		for name := range l.labels {
+			if !labels[name] {
+				delete(l.labels, name)
+			}
+		}
+		return nil, errs
 	}
-	return l.program, nil
+
+	// The line is always reachable, it's executed as soon as it's entered
+	l.reachable = true
+	return append([]byte(nil), l.program[pc:]...), nil
 }
 
-func (l *Lexer) parseParamOneByte(structure []string) error {
-	if len(structure) != 2 {
-		return fmt.Errorf("Expected int on line %d", l.line)
+// Diagnostics returns the errors and warnings found while parsing
+func (l *Lexer) Diagnostics() Diagnostics {
+	l.diags.sort()
+	return l.diags
+}
+
+func (l *Lexer) parseLine(line string) {
+	toks := l.tokenize(line)
+	if len(toks) == 0 {
+		return
 	}
 
-	code, err := strconv.ParseInt(structure[1], 10, 64)
-	if err != nil {
-		return err
+	label := toks[0].text
+	if label[len(label)-1] == ':' {
+		label = label[:len(label)-1]
+		if _, exists := l.labels[label]; exists {
+			l.errorf(toks[0], "Label %s is already defined", label)
+		}
+		l.labels[label] = l.pc
+		l.reachable = true
+		toks = toks[1:]
 	}
 
-	if code > 255 || code < 0 {
-		return fmt.Errorf("Exit code must be between 0-255, line %d", l.line)
+	if len(toks) == 0 {
+		return
 	}
 
-	l.addToProgram(byte(code))
-	return nil
+	bytecode, ok := bytecodes[strings.ToUpper(toks[0].text)]
+	if !ok {
+		l.errorf(toks[0], "Unknown instruction %s", toks[0].text)
+		return
+	}
+
+	if !l.reachable {
+		l.warnf(toks[0], "Unreachable instruction %s", toks[0].text)
+		l.reachable = true
+	}
+	l.lines = append(l.lines, vm.LineEntry{Addr: l.pc, Line: l.line})
+	l.addToProgram(bytecode)
+
+	switch bytecode {
+	case vm.Halt:
+		l.parseParamOneByte(toks)
+	case vm.PushI:
+		l.parseParamOneInt(toks)
+	case vm.PushReg:
+		l.parseParamOneRegister(toks)
+	case vm.PrintR:
+		l.parseParamOneRegister(toks)
+	case vm.PopReg:
+		l.parseParamOneRegister(toks)
+	case vm.Store:
+		l.parseParamOneRegister(toks)
+	case vm.SetI:
+		l.parseParamsRegIntOrLabel(toks)
+	case vm.Jump:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.JumpGtz:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.JumpLtz:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.JumpEq:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.JumpNeq:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.Call:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.PushStr:
+		l.parseParamOneString(toks)
+	case vm.SetStr:
+		l.parseParamsRegString(toks)
+	case vm.Param:
+		l.parseParamsRegInt(toks)
+	case vm.JumpReg:
+		l.parseParamOneRegister(toks)
+	case vm.Compare:
+		l.parseParamsTwoRegisters(toks)
+	case vm.JumpZGtz:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.JumpZLtz:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.JumpZEq:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.JumpZNeq:
+		l.parseParamOneIntOrLabel(toks)
+	case vm.Syscall:
+		l.parseParamHostFunc(toks)
+	case vm.PushF:
+		l.parseParamOneFloat(toks)
+	case vm.SetF:
+		l.parseParamsRegFloat(toks)
+	default:
+		l.checkOperands(toks, 0, "")
+	}
+
+	switch bytecode {
+	case vm.Halt, vm.Jump, vm.JumpReg, vm.Return:
+		l.reachable = false
+	}
 }
 
-func (l *Lexer) parseParamOneInt(structure []string) error {
-	if len(structure) != 2 {
-		return fmt.Errorf("Expected int on line %d", l.line)
+// checkOperands records an error if the instruction doesn't have n operands.
+// Operands that are present are still parsed to find any other problems.
+func (l *Lexer) checkOperands(toks []token, n int, expected string) bool {
+	if len(toks) > n+1 {
+		l.errorf(toks[n+1], "Unexpected operand %s", toks[n+1].text)
+		return false
 	}
-
-	code, err := strconv.ParseInt(structure[1], 10, 64)
-	if err != nil {
-		return err
+	if len(toks) < n+1 {
+		l.errorf(toks[len(toks)-1], "Expected %s after %s", expected, toks[0].text)
+		return false
 	}
-	l.addSliceToProgram(intToBytes(code))
-	return nil
+	return true
 }
 
-func (l *Lexer) parseParamOneIntOrLabel(structure []string) error {
-	if len(structure) != 2 {
-		return fmt.Errorf("Expected int on line %d", l.line)
+// operand returns the ith operand or an empty token if it's missing
+func operand(toks []token, i int) token {
+	if i < len(toks) {
+		return toks[i]
 	}
+	return token{}
+}
 
-	if structure[1][0] == '%' {
-		l.addLabelSub(structure[1][1:]) // Locations are 64 bits
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
+func (l *Lexer) parseParamOneByte(toks []token) {
+	l.checkOperands(toks, 1, "exit code")
+	tok := operand(toks, 1)
+	if tok.text == "" {
 		l.addToProgram(0)
-		return nil
+		return
 	}
 
-	code, err := strconv.ParseInt(structure[1], 10, 64)
+	code, err := strconv.ParseInt(tok.text, 10, 64)
 	if err != nil {
-		return err
+		l.errorf(tok, "Invalid exit code %s", tok.text)
+	} else if code > 255 || code < 0 {
+		l.errorf(tok, "Exit code must be between 0-255")
 	}
-	l.addSliceToProgram(intToBytes(code))
-	return nil
+
+	l.addToProgram(byte(code))
 }
 
-func (l *Lexer) parseParamsRegIntOrLabel(structure []string) error {
-	if len(structure) != 3 {
-		return fmt.Errorf("Expected int on line %d", l.line)
-	}
+func (l *Lexer) parseParamOneInt(toks []token) {
+	l.checkOperands(toks, 1, "int")
+	l.parseInt(operand(toks, 1))
+}
 
-	if structure[1][0] != '$' {
-		return fmt.Errorf("Expected register on line %d", l.line)
-	}
+func (l *Lexer) parseParamOneFloat(toks []token) {
+	l.checkOperands(toks, 1, "float")
+	l.parseFloat(operand(toks, 1))
+}
 
-	reg, ok := getRegister(structure[1][1:])
-	if !ok {
-		return fmt.Errorf("%s is not a register", structure[1])
-	}
-	l.addToProgram(reg)
+func (l *Lexer) parseParamOneIntOrLabel(toks []token) {
+	l.checkOperands(toks, 1, "int or label")
+	l.parseIntOrLabel(operand(toks, 1))
+}
 
-	if structure[2][0] == '%' {
-		l.addLabelSub(structure[2][1:]) // Locations are 64 bits
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		l.addToProgram(0)
-		return nil
-	}
+func (l *Lexer) parseParamHostFunc(toks []token) {
+	l.checkOperands(toks, 1, "host function name or ID")
+	tok := operand(toks, 1)
 
-	code, err := strconv.ParseInt(structure[2], 10, 64)
-	if err != nil {
-		return err
+	if tok.text != "" && tok.text[0] == '"' {
+		name, ok := l.stringLiteral(tok)
+		if ok {
+			l.addConstant(name)
+		}
+		l.addSliceToProgram(intToBytes(vm.HostID(name)))
+		return
 	}
-	l.addSliceToProgram(intToBytes(code))
-	return nil
-}
 
-func (l *Lexer) parseParamOneRegister(structure []string) error {
-	if len(structure) != 2 {
-		return fmt.Errorf("Expected register on line %d", l.line)
-	}
+	l.parseInt(tok)
+}
 
-	if structure[1][0] != '$' {
-		return fmt.Errorf("Expected register on line %d", l.line)
-	}
+func (l *Lexer) parseParamsRegIntOrLabel(toks []token) {
+	l.checkOperands(toks, 2, "register and int or label")
+	l.parseRegister(operand(toks, 1))
+	l.parseIntOrLabel(operand(toks, 2))
+}
 
-	reg, ok := getRegister(structure[1][1:])
-	if !ok {
-		return fmt.Errorf("%s is not a register", structure[1])
-	}
-	l.addToProgram(reg)
-	return nil
+func (l *Lexer) parseParamOneRegister(toks []token) {
+	l.checkOperands(toks, 1, "register")
+	l.parseRegister(operand(toks, 1))
 }
 
-func (l *Lexer) parseParamsTwoRegisters(structure []string) error {
-	if len(structure) != 3 {
-		return fmt.Errorf("Expected register on line %d", l.line)
-	}
+func (l *Lexer) parseParamsTwoRegisters(toks []token) {
+	l.checkOperands(toks, 2, "two registers")
+	l.parseRegister(operand(toks, 1))
+	l.parseRegister(operand(toks, 2))
+}
 
-	// First register
-	if structure[1][0] != '$' {
-		return fmt.Errorf("Expected register on line %d", l.line)
-	}
+func (l *Lexer) parseParamsRegInt(toks []token) {
+	l.checkOperands(toks, 2, "register and int")
+	l.parseRegister(operand(toks, 1))
+	l.parseInt(operand(toks, 2))
+}
 
-	reg, ok := getRegister(structure[1][1:])
-	if !ok {
-		return fmt.Errorf("%s is not a register", structure[1])
-	}
-	l.addToProgram(reg)
+func (l *Lexer) parseParamsRegFloat(toks []token) {
+	l.checkOperands(toks, 2, "register and float")
+	l.parseRegister(operand(toks, 1))
+	l.parseFloat(operand(toks, 2))
+}
 
-	// Second register
-	if structure[2][0] != '$' {
-		return fmt.Errorf("Expected register on line %d", l.line)
-	}
+func (l *Lexer) parseParamOneString(toks []token) {
+	l.checkOperands(toks, 1, "string")
+	l.parseString(operand(toks, 1))
+}
 
-	reg, ok = getRegister(structure[2][1:])
-	if !ok {
-		return fmt.Errorf("%s is not a register", structure[2])
-	}
-	l.addToProgram(reg)
-	return nil
+func (l *Lexer) parseParamsRegString(toks []token) {
+	l.checkOperands(toks, 2, "register and string")
+	l.parseRegister(operand(toks, 1))
+	l.parseString(operand(toks, 2))
 }
 
-func (l *Lexer) parseParamsRegInt(structure []string) error {
-	if len(structure) != 3 {
-		return fmt.Errorf("Expected register and int on line %d", l.line)
+// parseRegister adds a register operand to the program. A missing operand
+// is skipped as it's already been reported.
+func (l *Lexer) parseRegister(tok token) {
+	if tok.text == "" {
+		l.addToProgram(0)
+		return
 	}
 
-	if structure[1][0] != '$' {
-		return fmt.Errorf("Expected register on line %d", l.line)
+	if tok.text[0] != '$' {
+		l.errorf(tok, "Expected register, got %s", tok.text)
+		l.addToProgram(0)
+		return
 	}
 
-	// Register
-	reg, ok := getRegister(structure[1][1:])
+	reg, ok := getRegister(tok.text[1:])
 	if !ok {
-		return fmt.Errorf("%s is not a register", structure[1])
+		l.errorf(tok, "%s is not a register", tok.text)
 	}
 	l.addToProgram(reg)
+}
+
+func (l *Lexer) parseInt(tok token) {
+	if tok.text == "" {
+		l.addSliceToProgram(intToBytes(0))
+		return
+	}
 
-	// Value
-	code, err := strconv.ParseInt(structure[2], 10, 64)
+	code, err := strconv.ParseInt(tok.text, 10, 64)
 	if err != nil {
-		return err
+		l.errorf(tok, "Invalid int %s", tok.text)
 	}
 	l.addSliceToProgram(intToBytes(code))
-	return nil
 }
 
-func (l *Lexer) parseParamOneString(structure []string) error {
-	if len(structure) < 2 {
-		return fmt.Errorf("Expected string on line %d", l.line)
+func (l *Lexer) parseFloat(tok token) {
+	if tok.text == "" {
+		l.addSliceToProgram(intToBytes(0))
+		return
 	}
 
-	str := strings.Join(structure[1:], " ")
-	str = str[1:]
-	str = str[:len(str)-1]
-
-	strLen := len(str)
-	if strLen > 32768 {
-		return fmt.Errorf("String too long on line %d", l.line)
+	f, err := strconv.ParseFloat(tok.text, 64)
+	if err != nil {
+		l.errorf(tok, "Invalid float %s", tok.text)
 	}
-
-	// Push string lenth
-	l.addToProgram(byte(strLen >> 8))
-	l.addToProgram(byte(strLen))
-
-	// Add string literal
-	l.addSliceToProgram([]byte(str))
-	return nil
+	l.addSliceToProgram(intToBytes(int64(math.Float64bits(f))))
 }
 
-func (l *Lexer) parseParamsRegString(structure []string) error {
-	if len(structure) < 3 {
-		return fmt.Errorf("Expected string on line %d", l.line)
-	}
-
-	if structure[1][0] != '$' {
-		return fmt.Errorf("Expected register on line %d", l.line)
+func (l *Lexer) parseIntOrLabel(tok token) {
+	if tok.text != "" && tok.text[0] == '%' {
+		if len(tok.text) == 1 {
+			l.errorf(tok, "Expected label name after %%")
+		}
+		l.addLabelSub(tok) // Locations are 64 bits
+		l.addToProgram(0)
+		l.addToProgram(0)
+		l.addToProgram(0)
+		l.addToProgram(0)
+		l.addToProgram(0)
+		l.addToProgram(0)
+		l.addToProgram(0)
+		l.addToProgram(0)
+		return
 	}
 
-	// Register
-	reg, ok := getRegister(structure[1][1:])
-	if !ok {
-		return fmt.Errorf("%s is not a register", structure[1])
-	}
-	l.addToProgram(reg)
+	l.parseInt(tok)
+}
 
-	// String literal
-	str := strings.Join(structure[2:], " ")
-	str = str[1:]
-	str = str[:len(str)-1]
+func (l *Lexer) parseString(tok token) {
+	str, _ := l.stringLiteral(tok)
 
 	strLen := len(str)
-	if strLen > 32768 {
-		return fmt.Errorf("String too long on line %d", l.line)
+	if int64(strLen) > math.MaxUint32 {
+		l.errorf(tok, "String too long")
 	}
 
-	// Push string lenth
-	l.addToProgram(byte(strLen >> 8))
-	l.addToProgram(byte(strLen))
+	// Push string length
+	lenBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(lenBytes, uint32(strLen))
+	l.addSliceToProgram(lenBytes)
 
 	// Add string literal
 	l.addSliceToProgram([]byte(str))
-	return nil
 }
 
-func (l *Lexer) parseParamsIntReg(structure []string) error {
-	if len(structure) != 3 {
-		return fmt.Errorf("Expected register and int on line %d", l.line)
+// stringLiteral returns the contents of a quoted string token
+func (l *Lexer) stringLiteral(tok token) (string, bool) {
+	if tok.text == "" {
+		return "", false
 	}
 
-	// Value
-	code, err := strconv.ParseInt(structure[1], 10, 64)
-	if err != nil {
-		return err
+	if tok.text[0] != '"' {
+		l.errorf(tok, "Expected string, got %s", tok.text)
+		return "", false
 	}
-	l.addSliceToProgram(intToBytes(code))
 
-	if structure[2][0] != '$' {
-		return fmt.Errorf("Expected register on line %d", l.line)
+	if len(tok.text) < 2 || tok.text[len(tok.text)-1] != '"' {
+		l.errorf(tok, "Unterminated string")
+		return "", false
 	}
 
-	// Register
-	reg, ok := getRegister(structure[2][1:])
-	if !ok {
-		return fmt.Errorf("%s is not a register", structure[1])
+	return tok.text[1 : len(tok.text)-1], true
+}
+
+// addConstant adds a string to the program's constant pool if it's not already there
+func (l *Lexer) addConstant(str string) int {
+	if i, ok := l.constIdx[str]; ok {
+		return i
 	}
-	l.addToProgram(reg)
 
-	return nil
+	l.constIdx[str] = len(l.constants)
+	l.constants = append(l.constants, []byte(str))
+	return len(l.constants) - 1
 }
 
-func (l *Lexer) subLabels() error {
+func (l *Lexer) subLabels() {
 	for _, sub := range l.labelSubs {
-		loc, ok := l.labels[sub.label]
-		if !ok {
-			return fmt.Errorf("Label %s not defined", sub.label)
-		}
-
-		locBytes := intToBytes(loc)
-		l.program[sub.pos] = locBytes[0]
-		l.program[sub.pos+1] = locBytes[1]
-		l.program[sub.pos+2] = locBytes[2]
-		l.program[sub.pos+3] = locBytes[3]
-		l.program[sub.pos+4] = locBytes[4]
-		l.program[sub.pos+5] = locBytes[5]
-		l.program[sub.pos+6] = locBytes[6]
-		l.program[sub.pos+7] = locBytes[7]
+		l.subLabel(sub)
 	}
-	return nil
+}
+
+func (l *Lexer) subLabel(sub *sub) {
+	loc, ok := l.labels[sub.label]
+	if !ok {
+		if sub.label != "" {
+			l.diags.add(l.name, sub.line, sub.col, SeverityError, fmt.Sprintf("Label %s not defined", sub.label))
+		}
+		return
+	}
+
+	locBytes := intToBytes(loc)
+	l.program[sub.pos] = locBytes[0]
+	l.program[sub.pos+1] = locBytes[1]
+	l.program[sub.pos+2] = locBytes[2]
+	l.program[sub.pos+3] = locBytes[3]
+	l.program[sub.pos+4] = locBytes[4]
+	l.program[sub.pos+5] = locBytes[5]
+	l.program[sub.pos+6] = locBytes[6]
+	l.program[sub.pos+7] = locBytes[7]
 }
 
 func intToBytes(i int64) []byte {
 	out := make([]byte, 8)
-	binary.PutVarint(out, i)
+	binary.LittleEndian.PutUint64(out, uint64(i))
 	return out
 }
 
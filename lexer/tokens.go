@@ -20,10 +20,30 @@ var bytecodes = map[string]byte{
 	"SUB": vm.Sub,
 	"MUL": vm.Mul,
 	"DIV": vm.Div,
+	"MOD": vm.Mod,
+	"NEG": vm.Neg,
+	"ABS": vm.Abs,
+
+	"AND": vm.And,
+	"OR":  vm.Or,
+	"XOR": vm.Xor,
+	"NOT": vm.Not,
+	"SHL": vm.Shl,
+	"SHR": vm.Shr,
+	"SAR": vm.Sar,
+
+	"ADDC": vm.AddC,
+	"SUBC": vm.SubC,
+	"MULC": vm.MulC,
 
 	"SETI":   vm.SetI,
 	"SETSTR": vm.SetStr,
 
+	"PUSHF": vm.PushF,
+	"SETF":  vm.SetF,
+	"ITOF":  vm.IToF,
+	"FTOI":  vm.FToI,
+
 	"JMP":    vm.Jump,
 	"JMPGZ":  vm.JumpGtz,
 	"JMPLZ":  vm.JumpLtz,
@@ -42,14 +62,80 @@ var bytecodes = map[string]byte{
 	"CONCAT": vm.Concat,
 	"PARAM":  vm.Param,
 
+	"LEN":     vm.Len,
+	"SUBSTR":  vm.SubStr,
+	"INDEXOF": vm.IndexOf,
+	"CHARAT":  vm.CharAt,
+	"UPPER":   vm.Upper,
+	"LOWER":   vm.Lower,
+	"SPLIT":   vm.Split,
+	"TRIM":    vm.Trim,
+	"ITOA":    vm.IToA,
+	"ATOI":    vm.AToI,
+
+	"NEWARR": vm.NewArr,
+	"APPEND": vm.Append,
+	"GETIDX": vm.GetIdx,
+	"SETIDX": vm.SetIdx,
+	"ARRLEN": vm.ArrLen,
+
 	"CMP": vm.Compare,
 
+	"EQ": vm.Eq,
+	"NE": vm.Ne,
+	"LT": vm.Lt,
+	"LE": vm.Le,
+	"GT": vm.Gt,
+	"GE": vm.Ge,
+
 	"JMPZGZ":  vm.JumpZGtz,
 	"JMPZLZ":  vm.JumpZLtz,
 	"JMPZEQ":  vm.JumpZEq,
 	"JMPZNEQ": vm.JumpZNeq,
 
 	"STEP": vm.Step,
+
+	"SYSCALL": vm.Syscall,
+}
+
+// Names in bytecodes which are aliases of another instruction
+var aliases = map[string]bool{
+	"EXIT": true,
+}
+
+var mnemonics = make(map[byte]string, len(bytecodes))
+
+func init() {
+	for name, code := range bytecodes {
+		if !aliases[name] {
+			mnemonics[code] = name
+		}
+	}
+}
+
+// Mnemonic returns the assembly name of a bytecode
+func Mnemonic(code byte) (string, bool) {
+	name, ok := mnemonics[code]
+	return name, ok
+}
+
+// Register returns the number of a register by its assembly name, with or
+// without the dollar sign
+func Register(name string) (byte, bool) {
+	if len(name) > 0 && name[0] == '$' {
+		name = name[1:]
+	}
+	return getRegister(name)
+}
+
+// RegisterName returns the assembly name of a register, without the dollar sign
+func RegisterName(reg byte) (string, bool) {
+	for name, r := range registers {
+		if r == reg {
+			return name, true
+		}
+	}
+	return "", false
 }
 
 var registers = map[string]byte{
@@ -68,3 +154,53 @@ var registers = map[string]byte{
 	"I":  vm.I,
 	"J":  vm.J,
 }
+
+type token struct {
+	text string
+	col  int // Column in the source line starting at 1
+}
+
+// tokenize splits a line of source into whitespace separated tokens. Quoted
+// strings are kept as a single token and comments are dropped. A label
+// definition ends its token at the colon.
+func (l *Lexer) tokenize(line string) []token {
+	var toks []token
+	i := 0
+
+	for i < len(line) {
+		c := line[i]
+		if c == ' ' || c == '\t' || c == '\r' {
+			i++
+			continue
+		}
+		if c == ';' {
+			break
+		}
+
+		start := i
+		if c == '"' {
+			i++
+			for i < len(line) && line[i] != '"' {
+				i++
+			}
+			if i < len(line) {
+				i++ // Closing quote
+			}
+		} else {
+			for i < len(line) && !isSeparator(line[i]) {
+				i++
+				if line[i-1] == ':' && len(toks) == 0 {
+					break
+				}
+			}
+		}
+
+		toks = append(toks, token{text: line[start:i], col: start + 1})
+	}
+
+	return toks
+}
+
+func isSeparator(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == ';' || c == '"'
+}
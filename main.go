@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"flag"
 
+	"github.com/elemental-vm/test-vm/coverage"
+	"github.com/elemental-vm/test-vm/hosts"
 	"github.com/elemental-vm/test-vm/lexer"
+	"github.com/elemental-vm/test-vm/profile"
+	vmtrace "github.com/elemental-vm/test-vm/trace"
 	"github.com/elemental-vm/test-vm/vm"
 )
 
@@ -14,28 +20,55 @@ var (
 	debug   bool
 	compile bool
 	outFile string
+	timeout time.Duration
+	trace   string
+	prof    bool
+	pprof   string
+	cover   string
+
+	legacyCalls bool
+	checked     bool
+	heapLimit   int64
 )
 
 func init() {
 	flag.BoolVar(&debug, "d", false, "Enable debug output")
 	flag.BoolVar(&compile, "c", false, "Compile to byte file")
 	flag.StringVar(&outFile, "o", "", "Output file")
+	flag.DurationVar(&timeout, "timeout", 0, "Stop execution after this long, 0 to never stop")
+	flag.StringVar(&trace, "trace", "", "Write a JSON record of each executed instruction to this file")
+	flag.BoolVar(&prof, "profile", false, "Print the most executed functions and instructions to stderr")
+	flag.StringVar(&pprof, "pprof", "", "Write a pprof profile of the program to this file")
+	flag.StringVar(&cover, "cover", "", "Write an lcov coverage report to this file and print the coverage")
+	flag.BoolVar(&legacyCalls, "legacy-calls", false, "CALL and RETURN only use $RT and $FP, no call stack")
+	flag.BoolVar(&checked, "checked", false, "Fault on integer overflow instead of wrapping around")
+	flag.Int64Var(&heapLimit, "heap-limit", 0, "Most array items the program can make, 0 for no limit")
+}
+
+// Subcommands given as the first argument, each returns the exit code
+var commands = map[string]func(args []string) int{
+	"dap":     dapCommand,
+	"debug":   debugCommand,
+	"disasm":  disasmCommand,
+	"repl":    replCommand,
+	"test":    testCommand,
+	"upgrade": upgradeCommand,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	filename := flag.Arg(0)
 
-	theLexer, err := lexer.New(filename)
-	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
-	}
-
-	program, err := theLexer.Parse()
+	program, err := loadProgram(filename)
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
@@ -46,17 +79,141 @@ func main() {
 			return
 		}
 
-		file.Write(lexer.FileHeader)
-		file.Write(program)
+		data, err := program.MarshalBinary()
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		file.Write(data)
 		file.Close()
 		return
 	}
 
 	if debug {
-		fmt.Printf("%#v\n", program)
-		fmt.Println(len(program))
+		fmt.Printf("%#v\n", program.Code)
+		fmt.Println(len(program.Code))
+	}
+
+	ctx := context.Background()
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	opts := []vm.Option{vm.WithDebug(debug)}
+	if legacyCalls {
+		opts = append(opts, vm.WithLegacyCalls())
+	}
+	if checked {
+		opts = append(opts, vm.WithCheckedArithmetic())
+	}
+	if heapLimit > 0 {
+		opts = append(opts, vm.WithHeapLimit(heapLimit))
+	}
+
+	newvm := vm.Load(program, opts...)
+	if err := hosts.Register(newvm); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	var tracer *vmtrace.Tracer
+	var traceFile *os.File
+	if trace != "" {
+		traceFile, err = os.Create(trace)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		tracer = vmtrace.New(traceFile)
+		tracer.Attach(newvm)
+	}
+
+	var profiler *profile.Profiler
+	if prof || pprof != "" {
+		profiler = profile.New()
+		profiler.Attach(newvm)
+	}
+
+	var cov *coverage.Coverage
+	if cover != "" {
+		cov = coverage.New()
+		cov.Attach(newvm)
+	}
+
+	code, err := newvm.Run(ctx)
+	cancel()
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	if tracer != nil {
+		if err := tracer.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+		traceFile.Close()
+	}
+	if profiler != nil {
+		writeProfile(profiler)
+	}
+	if cov != nil {
+		writeCoverage(cov)
+	}
+	os.Exit(int(code))
+}
+
+// writeProfile prints the profiler's report and writes the pprof file if
+// they were asked for
+func writeProfile(profiler *profile.Profiler) {
+	profiler.Stop()
+	if prof {
+		profiler.Report(os.Stderr, 20)
 	}
 
-	newvm := vm.New(program)
-	os.Exit(int(newvm.Start(debug)))
+	if pprof != "" {
+		file, err := os.Create(pprof)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		if err := profiler.WritePprof(file); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+		file.Close()
+	}
+}
+
+// writeCoverage writes the lcov report and prints the coverage of each file
+func writeCoverage(cov *coverage.Coverage) {
+	file, err := os.Create(cover)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+	if err := cov.WriteLCOV(file); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	file.Close()
+
+	cov.Summary(os.Stderr)
+}
+
+// loadProgram assembles a source file or loads a compiled file. Assembler
+// warnings are printed to stderr.
+func loadProgram(filename string) (*vm.Program, error) {
+	theLexer, err := lexer.New(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	program, err := theLexer.Assemble()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, diag := range theLexer.Diagnostics() {
+		fmt.Fprintln(os.Stderr, diag.String())
+	}
+	return program, nil
 }
@@ -0,0 +1,217 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+)
+
+// Field numbers from pprof's profile.proto
+const (
+	profileSampleType    = 1
+	profileSample        = 2
+	profileMapping       = 3
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileTimeNanos     = 9
+	profileDurationNanos = 10
+	profilePeriodType    = 11
+	profilePeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	mappingID              = 1
+	mappingMemoryStart     = 2
+	mappingMemoryLimit     = 3
+	mappingFilename        = 5
+	mappingHasFunctions    = 7
+	mappingHasFilenames    = 8
+	mappingHasLineNumbers  = 9
+	mappingHasInlineFrames = 10
+
+	locationID        = 1
+	locationMappingID = 2
+	locationAddress   = 3
+	locationLine      = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID        = 1
+	functionName      = 2
+	functionSystem    = 3
+	functionFilename  = 4
+	functionStartLine = 5
+)
+
+// protoBuffer encodes protocol buffer messages
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) bool(field int, x bool) {
+	if x {
+		b.uint64(field, 1)
+	}
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.Bytes())
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var data protoBuffer
+	for _, x := range xs {
+		data.varint(x)
+	}
+	b.bytes(field, data.Bytes())
+}
+
+// WritePprof writes the sampled call stacks as a gzipped pprof profile which
+// can be read by go tool pprof. Each sample's value is also given as the
+// number of instructions it stands for.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	p.Stop()
+	prog := p.machine.Program()
+
+	strs := map[string]int64{"": 0}
+	table := []string{""}
+	str := func(s string) int64 {
+		if i, ok := strs[s]; ok {
+			return i
+		}
+		strs[s] = int64(len(table))
+		table = append(table, s)
+		return strs[s]
+	}
+
+	var out protoBuffer
+	valueType := func(field int, typ, unit string) {
+		var m protoBuffer
+		m.int64(valueTypeType, str(typ))
+		m.int64(valueTypeUnit, str(unit))
+		out.message(field, &m)
+	}
+	valueType(profileSampleType, "samples", "count")
+	valueType(profileSampleType, "instructions", "count")
+
+	// Samples in a fixed order so the same run gives the same file
+	keys := make([]string, 0, len(p.samples))
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	locations := make(map[int64]uint64)
+	var addrs []int64
+	for _, key := range keys {
+		s := p.samples[key]
+		ids := make([]uint64, len(s.stack))
+		for i, addr := range s.stack {
+			id, ok := locations[addr]
+			if !ok {
+				id = uint64(len(addrs) + 1)
+				locations[addr] = id
+				addrs = append(addrs, addr)
+			}
+			ids[i] = id
+		}
+
+		var m protoBuffer
+		m.packed(sampleLocationID, ids)
+		m.packed(sampleValue, []uint64{uint64(s.count), uint64(s.count * p.SampleInterval)})
+		out.message(profileSample, &m)
+	}
+
+	var mapping protoBuffer
+	mapping.uint64(mappingID, 1)
+	mapping.uint64(mappingMemoryStart, 0)
+	mapping.uint64(mappingMemoryLimit, uint64(len(prog.Code)))
+	mapping.int64(mappingFilename, str(prog.Source))
+	mapping.bool(mappingHasFunctions, true)
+	mapping.bool(mappingHasFilenames, true)
+	mapping.bool(mappingHasLineNumbers, true)
+	mapping.bool(mappingHasInlineFrames, true)
+	out.message(profileMapping, &mapping)
+
+	functions := make(map[*Function]uint64)
+	var funcs []*Function
+	for _, addr := range addrs {
+		fn := p.owner[addr]
+		id, ok := functions[fn]
+		if !ok {
+			id = uint64(len(funcs) + 1)
+			functions[fn] = id
+			funcs = append(funcs, fn)
+		}
+
+		var line protoBuffer
+		line.uint64(lineFunctionID, id)
+		line.int64(lineLine, int64(prog.LineFor(addr)))
+
+		var m protoBuffer
+		m.uint64(locationID, locations[addr])
+		m.uint64(locationMappingID, 1)
+		m.uint64(locationAddress, uint64(addr))
+		m.message(locationLine, &line)
+		out.message(profileLocation, &m)
+	}
+
+	for i, fn := range funcs {
+		var m protoBuffer
+		m.uint64(functionID, uint64(i+1))
+		m.int64(functionName, str(fn.Name))
+		m.int64(functionSystem, str(fn.Name))
+		m.int64(functionFilename, str(prog.Source))
+		m.int64(functionStartLine, int64(prog.LineFor(fn.Entry)))
+		out.message(profileFunction, &m)
+	}
+
+	out.int64(profileTimeNanos, p.start.UnixNano())
+	out.int64(profileDurationNanos, int64(p.end.Sub(p.start)))
+	valueType(profilePeriodType, "instructions", "count")
+	out.int64(profilePeriod, p.SampleInterval)
+
+	// The string table is written last as it's filled in by everything else
+	for _, s := range table {
+		out.bytes(profileStringTable, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,271 @@
+// Package profile counts the instructions a VM executes by address and by
+// function to find where a program spends its time.
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/elemental-vm/test-vm/lexer"
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+// DefaultSampleInterval is how often, in instructions, the call stack is
+// sampled for pprof profiles
+const DefaultSampleInterval = 100
+
+// Function is the instructions executed in a function
+type Function struct {
+	Name      string
+	Entry     int64
+	Calls     int64
+	Self      int64 // Instructions executed in the function itself
+	Inclusive int64 // Instructions executed in the function and anything it called
+
+	active int   // Calls to the function currently on the stack
+	start  int64 // Instruction count when the outermost active call began
+}
+
+// Instruction is the number of times an instruction was executed
+type Instruction struct {
+	Addr     int64
+	Count    int64
+	Function string
+}
+
+// activation is a call on the profiler's copy of the call stack
+type activation struct {
+	fn       *Function
+	callSite int64 // Address of the CALL instruction, -1 for the program entry
+}
+
+type sample struct {
+	stack []int64 // Addresses, innermost first
+	count int64
+}
+
+// Profiler counts each instruction executed by a VM and the instructions
+// executed inside each function. The call stack is sampled every
+// SampleInterval instructions for WritePprof.
+type Profiler struct {
+	SampleInterval int64
+
+	machine *vm.VM
+	counts  []int64 // Executions by address
+	owner   []*Function
+	funcs   map[int64]*Function
+	stack   []activation
+	lastPC  int64
+
+	samples map[string]*sample
+	key     []byte // Reused to look up samples
+	total   int64
+	start   time.Time
+	end     time.Time
+}
+
+// New creates a Profiler
+func New() *Profiler {
+	return &Profiler{
+		SampleInterval: DefaultSampleInterval,
+		funcs:          make(map[int64]*Function),
+		samples:        make(map[string]*sample),
+	}
+}
+
+// Attach adds the Profiler to a VM. Stop should be called once the VM has
+// finished.
+func (p *Profiler) Attach(machine *vm.VM) {
+	p.machine = machine
+	machine.AddHook(p.hook)
+}
+
+// Stop ends the profile, calls still on the stack are counted as returned
+func (p *Profiler) Stop() {
+	if !p.end.IsZero() {
+		return
+	}
+	p.end = time.Now()
+	for len(p.stack) > 0 {
+		p.exit()
+	}
+}
+
+func (p *Profiler) hook(machine *vm.VM) {
+	pc := machine.PC()
+
+	if p.counts == nil {
+		p.start = time.Now()
+		size := len(machine.Program().Code)
+		p.counts = make([]int64, size)
+		p.owner = make([]*Function, size)
+		p.enter(machine.Program().Entry, -1)
+	}
+	if pc < 0 || pc >= int64(len(p.counts)) {
+		return // Not an instruction, the VM reports it
+	}
+
+	// CALL and RETURN change the depth by one so only the newest frame is new
+	if depth := machine.CallDepth() + 1; depth != len(p.stack) {
+		for len(p.stack) < depth {
+			p.enter(machine.FrameAt(len(p.stack)-1).Entry, p.lastPC)
+		}
+		for len(p.stack) > depth {
+			p.exit()
+		}
+	}
+
+	fn := p.stack[len(p.stack)-1].fn
+	fn.Self++
+	p.counts[pc]++
+	if p.owner[pc] == nil {
+		p.owner[pc] = fn
+	}
+
+	p.total++
+	if p.total%p.SampleInterval == 0 {
+		p.sample(pc)
+	}
+	p.lastPC = pc
+}
+
+func (p *Profiler) enter(entry, callSite int64) {
+	fn, ok := p.funcs[entry]
+	if !ok {
+		fn = &Function{Name: p.name(entry), Entry: entry}
+		p.funcs[entry] = fn
+	}
+
+	fn.Calls++
+	if fn.active == 0 {
+		fn.start = p.total
+	}
+	fn.active++
+	p.stack = append(p.stack, activation{fn: fn, callSite: callSite})
+}
+
+func (p *Profiler) exit() {
+	fn := p.stack[len(p.stack)-1].fn
+	p.stack = p.stack[:len(p.stack)-1]
+
+	// Recursive calls only count once towards a function
+	fn.active--
+	if fn.active == 0 {
+		fn.Inclusive += p.total - fn.start
+	}
+}
+
+func (p *Profiler) sample(pc int64) {
+	p.key = p.key[:0]
+	p.key = strconv.AppendInt(p.key, pc, 16)
+	for i := len(p.stack) - 1; i > 0; i-- {
+		p.key = append(p.key, ' ')
+		p.key = strconv.AppendInt(p.key, p.stack[i].callSite, 16)
+	}
+
+	if s, ok := p.samples[string(p.key)]; ok {
+		s.count++
+		return
+	}
+
+	stack := []int64{pc}
+	for i := len(p.stack) - 1; i > 0; i-- {
+		stack = append(stack, p.stack[i].callSite)
+	}
+	p.samples[string(p.key)] = &sample{stack: stack, count: 1}
+}
+
+// Total returns the number of instructions executed
+func (p *Profiler) Total() int64 {
+	return p.total
+}
+
+// Functions returns the instructions executed in each function, most
+// inclusive instructions first. Inclusive counts are only complete once
+// Stop has been called.
+func (p *Profiler) Functions() []Function {
+	result := make([]Function, 0, len(p.funcs))
+	for _, fn := range p.funcs {
+		result = append(result, *fn)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Inclusive != result[j].Inclusive {
+			return result[i].Inclusive > result[j].Inclusive
+		}
+		return result[i].Entry < result[j].Entry
+	})
+	return result
+}
+
+// Instructions returns how many times each instruction was executed, most
+// executed first
+func (p *Profiler) Instructions() []Instruction {
+	var result []Instruction
+	for addr, count := range p.counts {
+		if count > 0 {
+			result = append(result, Instruction{
+				Addr:     int64(addr),
+				Count:    count,
+				Function: p.owner[addr].Name,
+			})
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+	return result
+}
+
+// Report writes the functions and the top instructions by count
+func (p *Profiler) Report(w io.Writer, top int) {
+	p.Stop()
+	fmt.Fprintf(w, "%d instructions in %s\n", p.total, p.end.Sub(p.start))
+	if p.total == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\n%10s %12s %7s %12s %7s  %s\n", "calls", "self", "self%", "inclusive", "incl%", "function")
+	for _, f := range p.Functions() {
+		fmt.Fprintf(w, "%10d %12d %6.2f%% %12d %6.2f%%  %s\n",
+			f.Calls, f.Self, p.percent(f.Self), f.Inclusive, p.percent(f.Inclusive), f.Name)
+	}
+
+	prog := p.machine.Program()
+	fmt.Fprintf(w, "\n%12s %7s  %-8s %-28s %s\n", "count", "%", "address", "instruction", "function")
+	for i, inst := range p.Instructions() {
+		if i == top {
+			break
+		}
+
+		text := "?"
+		if decoded, err := prog.Decode(inst.Addr); err == nil {
+			text = lexer.FormatInstruction(prog, decoded)
+		}
+		where := inst.Function
+		if line := prog.LineFor(inst.Addr); line > 0 {
+			where += fmt.Sprintf(" (%s:%d)", prog.Source, line)
+		}
+		fmt.Fprintf(w, "%12d %6.2f%%  0x%04X   %-28s %s\n", inst.Count, p.percent(inst.Count), inst.Addr, text, where)
+	}
+}
+
+func (p *Profiler) percent(n int64) float64 {
+	return float64(n) * 100 / float64(p.total)
+}
+
+// name returns the label of a function's entry or its address
+func (p *Profiler) name(entry int64) string {
+	best := ""
+	for label, addr := range p.machine.Program().Symbols {
+		if addr == entry && (best == "" || label < best) {
+			best = label
+		}
+	}
+	if best == "" {
+		return fmt.Sprintf("0x%04X", entry)
+	}
+	return best
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/elemental-vm/test-vm/hosts"
+	"github.com/elemental-vm/test-vm/lexer"
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+func replCommand(args []string) int {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 0, "Stop each line after this long, 0 to never stop")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: repl [-timeout duration]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	theLexer := lexer.NewString("repl", "")
+	machine := vm.Load(vm.NewProgram(nil))
+	if err := hosts.Register(machine); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	in := bufio.NewReader(os.Stdin)
+
+	for {
+		fmt.Print("> ")
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println()
+			return 0
+		}
+
+		code, err := theLexer.AssembleLine(line)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		if len(code) == 0 {
+			continue // Blank, comment or label only
+		}
+
+		if err := machine.Append(code); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+
+		ctx := context.Background()
+		cancel := func() {}
+		if *timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+		}
+
+		exit, err := machine.Run(ctx)
+		cancel()
+		if rerr, ok := err.(*vm.RuntimeError); ok && rerr.Kind == vm.ErrEndOfProgram {
+			err = nil // Ran everything entered so far
+		} else if err == nil {
+			fmt.Printf("Halted with exit code %d\n", exit)
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+
+		printState(os.Stdout, machine)
+	}
+}
+
+// printState prints the stack, TOS first, and the registers
+func printState(w io.Writer, machine *vm.VM) {
+	var stack []string
+	for i := int64(0); i < machine.StackDepth(); i++ {
+		val, _ := machine.StackValue(i)
+		stack = append(stack, val.String())
+	}
+	fmt.Fprintf(w, "stack: [%s]\n", strings.Join(stack, ", "))
+
+	var regs []string
+	for reg := vm.A; reg <= vm.J; reg++ {
+		name, _ := lexer.RegisterName(reg)
+		regs = append(regs, fmt.Sprintf("$%s=%s", name, machine.Register(reg)))
+	}
+	for _, reg := range []byte{vm.PC, vm.SP, vm.FP, vm.RT} {
+		name, _ := lexer.RegisterName(reg)
+		regs = append(regs, fmt.Sprintf("$%s=0x%X", name, machine.Register(reg).Int))
+	}
+	fmt.Fprintf(w, "registers: %s zero=%d\n", strings.Join(regs, " "), machine.ZeroFlag())
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elemental-vm/test-vm/hosts"
+	"github.com/elemental-vm/test-vm/lexer"
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+// Comments in a program giving the result it should have
+const (
+	expectOutput   = ";; expect-output:"
+	expectNoOutput = ";; expect-no-output"
+	expectExit     = ";; expect-exit:"
+	expectFault    = ";; expect-fault:"
+	expectChecked  = ";; expect-checked"
+)
+
+// expectations are what a test program should print and exit with
+type expectations struct {
+	output    []string
+	hasOutput bool
+	exit      int
+	hasExit   bool
+	fault     vm.ErrorKind
+	hasFault  bool
+	checked   bool // Run with checked arithmetic
+}
+
+func testCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	timeout := flags.Duration("timeout", time.Minute, "Fail a program that runs for longer than this")
+	verbose := flags.Bool("v", false, "List every program, not just failures")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: test [-timeout duration] [-v] [file or directory ...]")
+		fmt.Fprintln(os.Stderr, "Directories are searched for .ebc files, examples is used if none are given.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"examples"}
+	}
+
+	files, err := findPrograms(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	passed, failed, skipped := 0, 0, 0
+	for _, file := range files {
+		start := time.Now()
+		problems, ok, err := runTest(file, *timeout)
+		elapsed := time.Since(start).Seconds()
+
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("--- FAIL: %s\n    %s\n", file, err)
+		case !ok:
+			skipped++
+			if *verbose {
+				fmt.Printf("--- SKIP: %s (no expectations)\n", file)
+			}
+		case len(problems) > 0:
+			failed++
+			fmt.Printf("--- FAIL: %s (%.2fs)\n", file, elapsed)
+			for _, problem := range problems {
+				fmt.Println(indent(problem))
+			}
+		default:
+			passed++
+			if *verbose {
+				fmt.Printf("--- PASS: %s (%.2fs)\n", file, elapsed)
+			}
+		}
+	}
+
+	result := "PASS"
+	if failed > 0 {
+		result = "FAIL"
+	}
+	fmt.Printf("%s: %d passed, %d failed, %d skipped\n", result, passed, failed, skipped)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// findPrograms returns the .ebc files given or found in the directories given
+func findPrograms(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && filepath.Ext(file) == ".ebc" {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// readExpectations finds the expect comments in a source file. Each
+// expect-output comment is one line of output, expect-no-output says there
+// should be none. expect-fault gives the kind of fault the program stops
+// with, such as "stack underflow". expect-checked runs the program with
+// checked arithmetic.
+func readExpectations(file string) (expectations, error) {
+	var exp expectations
+
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return exp, err
+	}
+	if vm.IsCompiled(src) {
+		return exp, nil // Compiled files have no comments
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, expectOutput):
+			text := strings.TrimPrefix(line, expectOutput)
+			exp.output = append(exp.output, strings.TrimPrefix(text, " "))
+			exp.hasOutput = true
+		case line == expectNoOutput:
+			exp.hasOutput = true
+		case line == expectChecked:
+			exp.checked = true
+		case strings.HasPrefix(line, expectExit):
+			text := strings.TrimSpace(strings.TrimPrefix(line, expectExit))
+			code, err := strconv.Atoi(text)
+			if err != nil || code < 0 || code > 255 {
+				return exp, fmt.Errorf("%s:%d: Invalid exit code %q", file, n, text)
+			}
+			exp.exit = code
+			exp.hasExit = true
+		case strings.HasPrefix(line, expectFault):
+			text := strings.TrimSpace(strings.TrimPrefix(line, expectFault))
+			kind, ok := vm.ParseErrorKind(text)
+			if !ok {
+				return exp, fmt.Errorf("%s:%d: Unknown fault kind %q", file, n, text)
+			}
+			exp.fault = kind
+			exp.hasFault = true
+		}
+	}
+	return exp, scanner.Err()
+}
+
+// runTest runs a program and compares it against its expectations. false is
+// returned if the program has no expectations.
+func runTest(file string, timeout time.Duration) ([]string, bool, error) {
+	exp, err := readExpectations(file)
+	if err != nil {
+		return nil, true, err
+	}
+	if !exp.hasOutput && !exp.hasExit && !exp.hasFault {
+		return nil, false, nil
+	}
+
+	theLexer, err := lexer.New(file)
+	if err != nil {
+		return nil, true, err
+	}
+	program, err := theLexer.Assemble()
+	if err != nil {
+		return nil, true, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	opts := []vm.Option{
+		vm.WithStdin(strings.NewReader("")),
+		vm.WithStdout(&stdout),
+		vm.WithStderr(&stderr),
+	}
+	if exp.checked {
+		opts = append(opts, vm.WithCheckedArithmetic())
+	}
+
+	machine := vm.Load(program, opts...)
+	if err := hosts.Register(machine); err != nil {
+		return nil, true, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	code, runErr := machine.Run(ctx)
+	cancel()
+
+	var problems []string
+	rerr, _ := runErr.(*vm.RuntimeError)
+	switch {
+	case !exp.hasFault && runErr != nil:
+		problems = append(problems, runErr.Error())
+	case exp.hasFault && runErr == nil:
+		problems = append(problems, fmt.Sprintf("no fault, expected %s", exp.fault))
+	case exp.hasFault && (rerr == nil || rerr.Kind != exp.fault):
+		problems = append(problems, fmt.Sprintf("%s, expected %s", runErr, exp.fault))
+	}
+	if exp.hasExit && int(code) != exp.exit {
+		problems = append(problems, fmt.Sprintf("exit code %d, expected %d", code, exp.exit))
+	}
+
+	if exp.hasOutput {
+		output := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+		if stdout.Len() == 0 {
+			output = nil
+		}
+		if diff := diffLines(exp.output, output); diff != "" {
+			problems = append(problems, "output differs (-expected +actual):\n"+diff)
+		}
+	}
+	return problems, true, nil
+}
+
+// diffLines returns a line diff of two texts, or "" if they're the same
+func diffLines(a, b []string) string {
+	// lcs[i][j] is the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "-"+a[i])
+			i++
+			changed = true
+		default:
+			out = append(out, "+"+b[j])
+			j++
+			changed = true
+		}
+	}
+
+	if !changed {
+		return ""
+	}
+
+	// Only keep the lines near a change
+	const diffContext = 3
+	var trimmed []string
+	last := -1
+	for k, line := range out {
+		near := false
+		for d := k - diffContext; d <= k+diffContext; d++ {
+			if d >= 0 && d < len(out) && out[d][0] != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if last >= 0 && k != last+1 {
+			trimmed = append(trimmed, "...")
+		}
+		trimmed = append(trimmed, line)
+		last = k
+	}
+	return strings.Join(trimmed, "\n")
+}
+
+func indent(text string) string {
+	return "    " + strings.Replace(text, "\n", "\n    ", -1)
+}
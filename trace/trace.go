@@ -0,0 +1,158 @@
+// Package trace records every instruction a VM executes as a line of JSON.
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/elemental-vm/test-vm/lexer"
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+// Registers compared after each instruction
+var traced = []byte{vm.A, vm.B, vm.C, vm.D, vm.E, vm.F, vm.G, vm.H, vm.I, vm.J, vm.PC, vm.SP, vm.FP, vm.RT}
+
+// Record is the state of the machine after an instruction executed
+type Record struct {
+	Step     int64                  `json:"step"`     // 1 for the first instruction
+	PC       int64                  `json:"pc"`       // Address of the instruction
+	Op       string                 `json:"op"`       // Mnemonic
+	Operands []interface{}          `json:"operands"` // Registers as "$A", strings, integers and floats
+	Depth    int64                  `json:"depth"`    // Stack depth afterwards
+	TOS      interface{}            `json:"tos"`      // Top of the stack afterwards, null if it's empty
+	Changed  map[string]interface{} `json:"changed,omitempty"`
+}
+
+// Tracer writes a Record for each instruction executed by a VM
+type Tracer struct {
+	w       *bufio.Writer
+	enc     *json.Encoder
+	machine *vm.VM
+
+	step    int64
+	pending *Record            // Instruction being executed, written once it's finished
+	before  []vm.RegisterState // Registers before the pending instruction
+	err     error
+}
+
+// New creates a Tracer that writes records to w, one per line
+func New(w io.Writer) *Tracer {
+	bw := bufio.NewWriter(w)
+	return &Tracer{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Attach adds the Tracer to a VM. Close must be called once the VM has
+// finished to write the last instruction.
+func (t *Tracer) Attach(machine *vm.VM) {
+	t.machine = machine
+	machine.AddHook(t.hook)
+}
+
+// Close writes the record of the last instruction and flushes the output
+func (t *Tracer) Close() error {
+	t.finish()
+	if err := t.w.Flush(); err != nil && t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+func (t *Tracer) hook(machine *vm.VM) {
+	t.finish()
+
+	pc := machine.PC()
+	t.step++
+	rec := &Record{Step: t.step, PC: pc, Operands: []interface{}{}}
+
+	inst, err := machine.Program().Decode(pc)
+	if err != nil {
+		rec.Op = "?"
+	} else {
+		rec.Op, _ = lexer.Mnemonic(inst.Opcode)
+		for _, op := range inst.Operands {
+			rec.Operands = append(rec.Operands, operand(op))
+		}
+	}
+
+	t.before = t.before[:0]
+	for _, reg := range traced {
+		t.before = append(t.before, machine.RegisterState(reg))
+	}
+	t.pending = rec
+}
+
+// finish completes the pending record with the machine's current state
+func (t *Tracer) finish() {
+	rec := t.pending
+	if rec == nil {
+		return
+	}
+	t.pending = nil
+
+	rec.Depth = t.machine.StackDepth()
+	if tos, ok := t.machine.StackValue(0); ok {
+		rec.TOS = value(tos)
+	}
+
+	for i, reg := range traced {
+		if t.machine.RegisterState(reg).Same(t.before[i]) {
+			continue
+		}
+		if rec.Changed == nil {
+			rec.Changed = make(map[string]interface{})
+		}
+		name, _ := lexer.RegisterName(reg)
+		rec.Changed["$"+name] = value(t.machine.Register(reg))
+	}
+
+	if err := t.enc.Encode(rec); err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+func operand(op vm.Operand) interface{} {
+	switch op.Kind {
+	case vm.OperandReg:
+		if name, ok := lexer.RegisterName(byte(op.Int)); ok {
+			return "$" + name
+		}
+		return fmt.Sprintf("$0x%X", op.Int)
+	case vm.OperandStr:
+		return string(op.Str)
+	case vm.OperandFloat:
+		return float(op.Float)
+	}
+	return op.Int
+}
+
+func value(v vm.Value) interface{} {
+	switch v.Type {
+	case vm.TypeStr:
+		return v.Str
+	case vm.TypeFloat:
+		return float(v.Float)
+	case vm.TypeArray:
+		items := make([]interface{}, len(v.Array))
+		for i, item := range v.Array {
+			items[i] = value(item)
+		}
+		return items
+	}
+	return v.Int
+}
+
+// floatValue wraps a float so it isn't mistaken for an integer in the JSON
+type floatValue struct {
+	Float interface{} `json:"float"`
+}
+
+// float returns a float for JSON, which can't hold NaN or infinities
+func float(f float64) floatValue {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return floatValue{vm.Float(f).String()}
+	}
+	return floatValue{f}
+}
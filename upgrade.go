@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/elemental-vm/test-vm/vm"
+)
+
+func upgradeCommand(args []string) int {
+	flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	out := flags.String("o", "", "Output file, defaults to overwriting the input")
+	seti := flags.String("seti", "", "How to treat SETI operands that could be labels: labels or values")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: upgrade [-o file] [-seti labels|values] program")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var mode vm.SETIOperands
+	switch *seti {
+	case "":
+		mode = vm.SETIAmbiguous
+	case "labels":
+		mode = vm.SETILabels
+	case "values":
+		mode = vm.SETIValues
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown -seti mode %q, expected labels or values\n", *seti)
+		return 2
+	}
+
+	in := flags.Arg(0)
+	if *out == "" {
+		*out = in
+	}
+
+	data, err := ioutil.ReadFile(in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	program, err := vm.ReadProgram(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", in, err)
+		return 1
+	}
+
+	if program.ISAVersion == vm.ISAVersion && program.FormatVersion == vm.FormatVersion {
+		fmt.Fprintf(os.Stderr, "%s is already up to date\n", in)
+		if *out == in {
+			return 0
+		}
+	}
+
+	if err := program.Upgrade(mode); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", in, err)
+		if _, ok := err.(*vm.AmbiguousError); ok {
+			fmt.Fprintln(os.Stderr, "Choose how to upgrade them with -seti labels or -seti values")
+		}
+		return 1
+	}
+
+	data, err = program.MarshalBinary()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
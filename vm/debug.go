@@ -0,0 +1,130 @@
+package vm
+
+import (
+	"bytes"
+	"math"
+)
+
+// Hook is called before each instruction is executed. The program counter is
+// the address of the instruction about to run. Hooks may inspect and change
+// the machine, or call Stop to end execution.
+type Hook func(vm *VM)
+
+// AddHook adds a function to call before each instruction
+func (vm *VM) AddHook(h Hook) {
+	vm.hooks = append(vm.hooks, h)
+}
+
+// OnStep sets a function to call when a STEP instruction is executed instead
+// of starting the built in step prompt
+func (vm *VM) OnStep(h Hook) {
+	vm.onStep = h
+}
+
+// Stop ends execution before the next instruction. Run returns a
+// RuntimeError with the kind ErrCancelled.
+func (vm *VM) Stop() {
+	vm.fault(ErrCancelled, "stopped by host")
+}
+
+// Frame is an entry on the call stack
+type Frame struct {
+	Return int64 // Return address
+	FP     int64 // Caller's frame pointer
+	Entry  int64 // Address of the called function
+}
+
+// Frames returns the call stack with the innermost call last
+func (vm *VM) Frames() []Frame {
+	frames := make([]Frame, len(vm.frames))
+	for i, f := range vm.frames {
+		frames[i] = Frame{
+			Return: f.ret,
+			FP:     f.fp,
+			Entry:  f.entry,
+		}
+	}
+	return frames
+}
+
+// CallDepth returns the number of frames on the call stack
+func (vm *VM) CallDepth() int {
+	return len(vm.frames)
+}
+
+// FrameAt returns the ith frame on the call stack, 0 being the outermost call.
+// Unlike Frames the call stack isn't copied.
+func (vm *VM) FrameAt(i int) Frame {
+	f := vm.frames[i]
+	return Frame{Return: f.ret, FP: f.fp, Entry: f.entry}
+}
+
+// IsInstruction reports if addr is the start of an instruction. It's only
+// known once the program has been prepared.
+func (vm *VM) IsInstruction(addr int64) bool {
+	return addr >= 0 && addr < int64(len(vm.starts)) && vm.starts[addr]
+}
+
+// PC returns the address of the next instruction to execute
+func (vm *VM) PC() int64 {
+	return vm.getPC()
+}
+
+// ZeroFlag returns the result of the last CMP instruction
+func (vm *VM) ZeroFlag() int8 {
+	return vm.flags.zero
+}
+
+// StackDepth returns the number of values on the stack
+func (vm *VM) StackDepth() int64 {
+	return vm.registers[SP].iVal
+}
+
+// RegisterState identifies the value in a register without copying it, so
+// it's cheap enough to take on every instruction
+type RegisterState struct {
+	v vmValue
+	n int // Length of an array when the state was taken
+}
+
+// RegisterState returns the state of register reg
+func (vm *VM) RegisterState(reg byte) RegisterState {
+	if int(reg) >= len(vm.registers) {
+		return RegisterState{}
+	}
+	s := RegisterState{v: *vm.registers[reg]}
+	if s.v.t == regArr {
+		s.n = len(s.v.aVal.items)
+	}
+	return s
+}
+
+// Same reports whether the register held the same value in both states.
+// Floats are compared bit for bit so NaN is the same as itself, and arrays
+// are the same if they're the same array with the same length, whatever its
+// items were set to.
+func (s RegisterState) Same(o RegisterState) bool {
+	a, b := &s.v, &o.v
+	if a.t != b.t {
+		return false
+	}
+	switch a.t {
+	case regStr:
+		return bytes.Equal(a.sVal, b.sVal)
+	case regFloat:
+		return math.Float64bits(a.fVal) == math.Float64bits(b.fVal)
+	case regArr:
+		return a.aVal == b.aVal && s.n == o.n
+	}
+	return a.iVal == b.iVal
+}
+
+// StackValue returns a copy of the value i slots below the top of the stack,
+// 0 being TOS. false is returned if there's no such value.
+func (vm *VM) StackValue(i int64) (Value, bool) {
+	slot := vm.registers[SP].iVal - 1 - i
+	if i < 0 || slot < 0 || slot >= int64(len(vm.stack)) || vm.stack[slot] == nil {
+		return Value{}, false
+	}
+	return vm.stack[slot].export(), true
+}
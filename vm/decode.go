@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Operand is a decoded instruction operand
+type Operand struct {
+	Addr  int64 // Address of the encoded operand
+	Kind  OperandKind
+	Int   int64 // Value of every operand kind except strings, the bits of floats
+	Float float64
+	Str   []byte
+}
+
+// Instruction is a decoded instruction
+type Instruction struct {
+	Addr     int64
+	Opcode   byte
+	Name     string
+	Operands []Operand
+	Size     int64 // Size in bytes including operands
+}
+
+// InstructionName returns the name of a bytecode and whether it's defined
+func InstructionName(code byte) (string, bool) {
+	name, ok := instructions[code]
+	return name, ok
+}
+
+// Decode decodes the instruction at addr in code using the current operand encoding
+func Decode(code []byte, addr int64) (Instruction, error) {
+	return decode(code, addr, ISAVersion)
+}
+
+// Decode decodes the instruction at addr using the program's operand encoding
+func (p *Program) Decode(addr int64) (Instruction, error) {
+	return decode(p.Code, addr, p.ISAVersion)
+}
+
+func decode(code []byte, addr int64, isa uint16) (Instruction, error) {
+	if addr < 0 || addr >= int64(len(code)) {
+		return Instruction{}, fmt.Errorf("Address 0x%X is outside the program", addr)
+	}
+
+	inst := Instruction{
+		Addr:   addr,
+		Opcode: code[addr],
+	}
+
+	var ok bool
+	if inst.Name, ok = instructions[inst.Opcode]; !ok {
+		return inst, fmt.Errorf("Unknown bytecode 0x%X at 0x%X", inst.Opcode, addr)
+	}
+
+	pos := addr + 1
+	for _, kind := range operands[inst.Opcode] {
+		op := Operand{Addr: pos, Kind: kind}
+
+		switch kind {
+		case OperandByte, OperandReg:
+			if pos+1 > int64(len(code)) {
+				return inst, fmt.Errorf("Truncated %s instruction at 0x%X", inst.Name, addr)
+			}
+			op.Int = int64(code[pos])
+			pos++
+		case OperandStr:
+			width := int64(4)
+			if isa == 1 {
+				width = 2
+			}
+			if pos+width > int64(len(code)) {
+				return inst, fmt.Errorf("Truncated %s instruction at 0x%X", inst.Name, addr)
+			}
+
+			var l int64
+			if isa == 1 {
+				l = int64((int16(code[pos]) << 8) + int16(code[pos+1]))
+			} else {
+				l = int64(binary.LittleEndian.Uint32(code[pos:]))
+			}
+			pos += width
+
+			if l < 0 || pos+l > int64(len(code)) {
+				return inst, fmt.Errorf("Truncated %s instruction at 0x%X", inst.Name, addr)
+			}
+			op.Str = code[pos : pos+l]
+			pos += l
+		default:
+			if pos+8 > int64(len(code)) {
+				return inst, fmt.Errorf("Truncated %s instruction at 0x%X", inst.Name, addr)
+			}
+			if isa == 1 {
+				op.Int, _ = binary.Varint(code[pos : pos+8])
+			} else {
+				op.Int = int64(binary.LittleEndian.Uint64(code[pos:]))
+			}
+			if kind == OperandFloat {
+				op.Float = math.Float64frombits(uint64(op.Int))
+			}
+			pos += 8
+		}
+
+		inst.Operands = append(inst.Operands, op)
+	}
+
+	inst.Size = pos - addr
+	return inst, nil
+}
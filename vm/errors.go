@@ -0,0 +1,165 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrorKind classifies a RuntimeError
+type ErrorKind uint8
+
+const (
+	// ErrTypeMismatch is raised when an instruction is given a value of the wrong type
+	ErrTypeMismatch ErrorKind = iota
+	// ErrUnknownOpcode is raised when the program contains an undefined bytecode
+	ErrUnknownOpcode
+	// ErrEndOfProgram is raised when execution runs past the end of the program
+	ErrEndOfProgram
+	// ErrStackOverflow is raised when a value is pushed onto a full stack
+	ErrStackOverflow
+	// ErrStackUnderflow is raised when a value is read from an empty stack
+	ErrStackUnderflow
+	// ErrUnknownHost is raised when SYSCALL names a host function that isn't registered
+	ErrUnknownHost
+	// ErrHost is raised when a host function returns an error
+	ErrHost
+	// ErrCancelled is returned when the context given to Run is cancelled
+	ErrCancelled
+	// ErrDeadlineExceeded is returned when the deadline of the context given to Run passes
+	ErrDeadlineExceeded
+	// ErrInvalidProgram is returned when the program fails verification before it's run
+	ErrInvalidProgram
+	// ErrInvalidJump is raised when a computed jump or return address is not an instruction
+	ErrInvalidJump
+	// ErrConversion is raised when a value can't be converted to another type
+	ErrConversion
+	// ErrInvalidOperand is raised when an instruction is given a value it can't use, such as a negative shift
+	ErrInvalidOperand
+	// ErrDivideByZero is raised when an integer is divided by zero
+	ErrDivideByZero
+	// ErrOverflow is raised when checked integer arithmetic overflows
+	ErrOverflow
+	// ErrOutOfBounds is raised when an index or range is outside a string or array
+	ErrOutOfBounds
+	// ErrOutOfMemory is raised when arrays would hold more items than the VM's heap limit
+	ErrOutOfMemory
+)
+
+var errorKinds = map[ErrorKind]string{
+	ErrTypeMismatch:     "type mismatch",
+	ErrUnknownOpcode:    "unknown opcode",
+	ErrEndOfProgram:     "end of program",
+	ErrStackOverflow:    "stack overflow",
+	ErrStackUnderflow:   "stack underflow",
+	ErrUnknownHost:      "unknown host function",
+	ErrHost:             "host function error",
+	ErrCancelled:        "cancelled",
+	ErrDeadlineExceeded: "deadline exceeded",
+	ErrInvalidProgram:   "invalid program",
+	ErrInvalidJump:      "invalid jump",
+	ErrConversion:       "conversion error",
+	ErrInvalidOperand:   "invalid operand",
+	ErrDivideByZero:     "division by zero",
+	ErrOverflow:         "integer overflow",
+	ErrOutOfBounds:      "out of bounds",
+	ErrOutOfMemory:      "out of memory",
+}
+
+func (k ErrorKind) String() string {
+	if s, ok := errorKinds[k]; ok {
+		return s
+	}
+	return "unknown error"
+}
+
+// ParseErrorKind returns the ErrorKind with the name String gives it
+func ParseErrorKind(name string) (ErrorKind, bool) {
+	for kind, s := range errorKinds {
+		if s == name {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// RuntimeError is returned when a program faults during execution. It contains
+// the state of the machine at the time of the fault.
+type RuntimeError struct {
+	Kind        ErrorKind
+	Msg         string
+	PC          int64  // Address of the faulting instruction
+	Opcode      byte   // Bytecode of the faulting instruction
+	Instruction string // Name of the faulting instruction
+	StackDepth  int64  // Value of the stack pointer
+
+	Registers []Value // Indexed by register number
+	Stack     []Value // Bottom of the stack first
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("%s at 0x%X (%s): %s", e.Kind, e.PC, e.Instruction, e.Msg)
+}
+
+// fault stops execution with a RuntimeError. Only the first fault is kept.
+func (vm *VM) fault(kind ErrorKind, format string, a ...interface{}) {
+	if vm.err != nil {
+		return
+	}
+
+	// Execution may have run off the end of the program in which case there's no instruction
+	var code byte
+	name := "none"
+	if vm.opPC >= 0 && vm.opPC < int64(len(vm.program)) {
+		code = vm.program[vm.opPC]
+		var ok bool
+		if name, ok = instructions[code]; !ok {
+			name = fmt.Sprintf("0x%X", code)
+		}
+	}
+
+	// Each array is copied once however many references there are to it, so
+	// the snapshot is no bigger than the arrays the heap limit allowed
+	seen := make(map[*array][]Value)
+	vm.err = &RuntimeError{
+		Kind:        kind,
+		Msg:         fmt.Sprintf(format, a...),
+		PC:          vm.opPC,
+		Opcode:      code,
+		Instruction: name,
+		StackDepth:  vm.registers[SP].iVal,
+		Registers:   vm.snapshotRegisters(seen),
+		Stack:       vm.snapshotStack(seen),
+	}
+}
+
+// cancelled stops execution because the context given to Run is done
+func (vm *VM) cancelled(err error) {
+	if err == context.DeadlineExceeded {
+		vm.fault(ErrDeadlineExceeded, "execution stopped")
+	} else {
+		vm.fault(ErrCancelled, "execution stopped")
+	}
+}
+
+func (vm *VM) snapshotRegisters(seen map[*array][]Value) []Value {
+	regs := make([]Value, len(vm.registers))
+	for i, r := range vm.registers {
+		regs[i] = r.exportShared(seen)
+	}
+	return regs
+}
+
+func (vm *VM) snapshotStack(seen map[*array][]Value) []Value {
+	sp := vm.registers[SP].iVal
+	if sp < 0 {
+		sp = 0
+	} else if sp > int64(len(vm.stack)) {
+		sp = int64(len(vm.stack))
+	}
+
+	stack := make([]Value, sp)
+	for i := range stack {
+		stack[i] = vm.stack[i].exportShared(seen)
+	}
+	return stack
+}
@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// HostFunc is a Go function a program can call with SYSCALL. The arguments are
+// popped from the stack with the deepest value first. The results are pushed
+// onto the stack in order so the last result becomes TOS.
+type HostFunc func(vm *VM, args []Value) ([]Value, error)
+
+type hostFunc struct {
+	name  string
+	arity int
+	fn    HostFunc
+}
+
+// HostID returns the ID the assembler uses for a host function name
+func HostID(name string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int64(h.Sum32())
+}
+
+// RegisterHost makes fn callable with SYSCALL "name". arity is the number of
+// values popped from the stack as arguments and can't be negative. The ID of
+// the function is returned. IDs are hashes of names, so registering a name
+// whose ID is already taken by another function is an error.
+func (vm *VM) RegisterHost(name string, arity int, fn HostFunc) (int64, error) {
+	if arity < 0 {
+		return 0, fmt.Errorf("Host function %q can't take %d arguments", name, arity)
+	}
+
+	id := HostID(name)
+	if existing, ok := vm.hostFuncs[id]; ok && existing.name != name {
+		return 0, fmt.Errorf("Host function %q has the same ID as %s", name, existing)
+	}
+	vm.hostFuncs[id] = &hostFunc{
+		name:  name,
+		arity: arity,
+		fn:    fn,
+	}
+	return id, nil
+}
+
+// RegisterHostID makes fn callable with SYSCALL id. The ID can't already be
+// taken by a function registered by name.
+func (vm *VM) RegisterHostID(id int64, arity int, fn HostFunc) error {
+	if arity < 0 {
+		return fmt.Errorf("Host function %d can't take %d arguments", id, arity)
+	}
+	if existing, ok := vm.hostFuncs[id]; ok && existing.name != "" {
+		return fmt.Errorf("Host function %d is already taken by %s", id, existing)
+	}
+
+	vm.hostFuncs[id] = &hostFunc{
+		arity: arity,
+		fn:    fn,
+	}
+	return nil
+}
+
+// Register returns a copy of the value in register reg
+func (vm *VM) Register(reg byte) Value {
+	if int(reg) >= len(vm.registers) {
+		return Value{}
+	}
+	return vm.registers[reg].export()
+}
+
+// SetRegister sets register reg to v. $PC can only be set to the start of an
+// instruction and $SP can't be set past the values on the stack. A value that
+// can't be set is returned as an error and the VM is left as it was.
+func (vm *VM) SetRegister(reg byte, v Value) error {
+	if int(reg) >= len(vm.registers) {
+		return fmt.Errorf("0x%X is not a register", reg)
+	}
+
+	val := importValue(v)
+	if _, msg := vm.checkRegister(reg, val); msg != "" {
+		return errors.New(msg)
+	}
+	*vm.registers[reg] = *val
+	return nil
+}
+
+func (h *hostFunc) String() string {
+	if h.name == "" {
+		return "a function registered by ID"
+	}
+	return fmt.Sprintf("%q", h.name)
+}
+
+// calls faults unless the program's constant pool names host for id. Names
+// are hashed to IDs, so a program calling an unregistered name can have the
+// ID of a different function.
+func (vm *VM) calls(host *hostFunc, id int64) bool {
+	names := vm.hostNames[id]
+	if host.name == "" || len(names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if name == host.name {
+			return true
+		}
+	}
+	vm.fault(ErrUnknownHost, "no host function %q, %q has the same ID", names[0], host.name)
+	return false
+}
+
+func (vm *VM) opSyscall() {
+	id := vm.getInt64()
+	host, ok := vm.hostFuncs[id]
+	if !ok {
+		if names := vm.hostNames[id]; len(names) > 0 {
+			vm.fault(ErrUnknownHost, "no host function %q", names[0])
+		} else {
+			vm.fault(ErrUnknownHost, "no host function with ID %d", id)
+		}
+		return
+	}
+	if !vm.calls(host, id) {
+		return
+	}
+
+	if !vm.checkDepth(int64(host.arity)) {
+		return
+	}
+
+	args := make([]Value, host.arity)
+	seen := make(map[*array][]Value)
+	for i := host.arity - 1; i >= 0; i-- {
+		args[i] = vm.popStack().exportShared(seen)
+	}
+
+	results, err := host.fn(vm, args)
+	if err != nil {
+		vm.fault(ErrHost, "%s: %s", host.name, err.Error())
+		return
+	}
+
+	var items int64
+	for _, r := range results {
+		items += r.items()
+	}
+	if !vm.allocItems("SYSCALL", items) {
+		return
+	}
+
+	for _, r := range results {
+		vm.pushStack(importValue(r))
+	}
+}
@@ -48,6 +48,53 @@ const (
 	JumpZNeq // 0x21
 
 	Step // 0x22
+
+	Syscall // 0x23
+
+	PushF // 0x24
+	SetF  // 0x25
+	IToF  // 0x26
+	FToI  // 0x27
+
+	Mod // 0x28
+	Neg // 0x29
+	Abs // 0x2A
+
+	And // 0x2B
+	Or  // 0x2C
+	Xor // 0x2D
+	Not // 0x2E
+	Shl // 0x2F
+	Shr // 0x30
+	Sar // 0x31
+
+	AddC // 0x32
+	SubC // 0x33
+	MulC // 0x34
+
+	Eq // 0x35
+	Ne // 0x36
+	Lt // 0x37
+	Le // 0x38
+	Gt // 0x39
+	Ge // 0x3A
+
+	Len     // 0x3B
+	SubStr  // 0x3C
+	IndexOf // 0x3D
+	CharAt  // 0x3E
+	Upper   // 0x3F
+	Lower   // 0x40
+	Split   // 0x41
+	Trim    // 0x42
+	IToA    // 0x43
+	AToI    // 0x44
+
+	NewArr // 0x45
+	Append // 0x46
+	GetIdx // 0x47
+	SetIdx // 0x48
+	ArrLen // 0x49
 )
 
 var instructions = map[byte]string{
@@ -97,6 +144,113 @@ var instructions = map[byte]string{
 	JumpZNeq: "JumpZNeq",
 
 	Step: "Step",
+
+	Syscall: "Syscall",
+
+	PushF: "PushF",
+	SetF:  "SetF",
+	IToF:  "IToF",
+	FToI:  "FToI",
+
+	Mod: "Mod",
+	Neg: "Neg",
+	Abs: "Abs",
+
+	And: "And",
+	Or:  "Or",
+	Xor: "Xor",
+	Not: "Not",
+	Shl: "Shl",
+	Shr: "Shr",
+	Sar: "Sar",
+
+	AddC: "AddC",
+	SubC: "SubC",
+	MulC: "MulC",
+
+	Eq: "Eq",
+	Ne: "Ne",
+	Lt: "Lt",
+	Le: "Le",
+	Gt: "Gt",
+	Ge: "Ge",
+
+	Len:     "Len",
+	SubStr:  "SubStr",
+	IndexOf: "IndexOf",
+	CharAt:  "CharAt",
+	Upper:   "Upper",
+	Lower:   "Lower",
+	Split:   "Split",
+	Trim:    "Trim",
+	IToA:    "IToA",
+	AToI:    "AToI",
+
+	NewArr: "NewArr",
+	Append: "Append",
+	GetIdx: "GetIdx",
+	SetIdx: "SetIdx",
+	ArrLen: "ArrLen",
+}
+
+// OperandKind is how an instruction operand is encoded
+type OperandKind uint8
+
+const (
+	// OperandByte is a single byte value such as an exit code
+	OperandByte OperandKind = iota
+	// OperandReg is a single byte register number
+	OperandReg
+	// OperandInt is an 8 byte integer
+	OperandInt
+	// OperandAddr is an 8 byte program address
+	OperandAddr
+	// OperandIntOrAddr is an 8 byte integer which may be a program address
+	OperandIntOrAddr
+	// OperandStr is a 4 byte length followed by the string. Version 1 used a 2 byte length.
+	OperandStr
+	// OperandHost is an 8 byte host function ID
+	OperandHost
+	// OperandFloat is an 8 byte IEEE 754 float
+	OperandFloat
+)
+
+var operands = map[byte][]OperandKind{
+	Halt: {OperandByte},
+
+	PushI:   {OperandInt},
+	PushStr: {OperandStr},
+	PushReg: {OperandReg},
+	PopReg:  {OperandReg},
+	Store:   {OperandReg},
+
+	SetI:   {OperandReg, OperandIntOrAddr},
+	SetStr: {OperandReg, OperandStr},
+
+	Jump:    {OperandAddr},
+	JumpGtz: {OperandAddr},
+	JumpLtz: {OperandAddr},
+	JumpEq:  {OperandAddr},
+	JumpNeq: {OperandAddr},
+
+	PrintR: {OperandReg},
+
+	Call: {OperandAddr},
+
+	Param:   {OperandReg, OperandInt},
+	JumpReg: {OperandReg},
+
+	Compare: {OperandReg, OperandReg},
+
+	JumpZGtz: {OperandAddr},
+	JumpZLtz: {OperandAddr},
+	JumpZEq:  {OperandAddr},
+	JumpZNeq: {OperandAddr},
+
+	Syscall: {OperandHost},
+
+	PushF: {OperandFloat},
+	SetF:  {OperandReg, OperandFloat},
 }
 
 // Registers
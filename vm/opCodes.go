@@ -1,7 +1,10 @@
 package vm
 
 import (
+	"bytes"
 	"encoding/binary"
+	"math"
+	"strconv"
 )
 
 func (vm *VM) opPushI() {
@@ -11,12 +14,10 @@ func (vm *VM) opPushStr() {
 	vm.pushStackStr(vm.fetchString())
 }
 func (vm *VM) opPushReg() {
-	reg := vm.registers[vm.fetch()]
-	if reg.t == regInt {
-		vm.pushStackI(reg.iVal)
-	} else {
-		vm.pushStackStr(reg.sVal)
-	}
+	vm.pushStack(vm.registers[vm.fetch()])
+}
+func (vm *VM) opPushF() {
+	vm.pushStackF(vm.getFloat64())
 }
 func (vm *VM) opDup() {
 	vm.pushStack(vm.getTOS())
@@ -25,113 +26,272 @@ func (vm *VM) opPop() {
 	vm.popStack()
 }
 func (vm *VM) opPopReg() {
-	vm.registers[vm.fetch()] = vm.popStack()
+	reg := vm.fetch()
+	v := vm.popStack()
+	if vm.err == nil {
+		vm.setRegister(reg, v)
+	}
 }
 func (vm *VM) opStore() {
-	vm.registers[vm.fetch()] = vm.getTOS()
+	reg := vm.fetch()
+	v := vm.getTOS()
+	if vm.err == nil {
+		vm.setRegister(reg, v)
+	}
 }
 func (vm *VM) opSwap() {
+	if !vm.checkDepth(2) {
+		return
+	}
+
 	csp := vm.registers[SP].iVal
 	vm.stack[csp-2], vm.stack[csp-1] = vm.stack[csp-1], vm.stack[csp-2]
 }
 
 func (vm *VM) opAdd() {
+	vm.arith("ADD", vm.flags.checked, addInt, func(a, b float64) float64 { return a + b })
+}
+func (vm *VM) opSub() {
+	vm.arith("SUB", vm.flags.checked, subInt, func(a, b float64) float64 { return a - b })
+}
+func (vm *VM) opMul() {
+	vm.arith("MUL", vm.flags.checked, mulInt, func(a, b float64) float64 { return a * b })
+}
+func (vm *VM) opDiv() {
+	vm.arith("DIV", vm.flags.checked, divInt, func(a, b float64) float64 { return a / b })
+}
+func (vm *VM) opMod() {
+	vm.arith("MOD", vm.flags.checked, modInt, math.Mod)
+}
+
+// ADDC, SUBC and MULC always trap on overflow
+func (vm *VM) opAddC() {
+	vm.arith("ADDC", true, addInt, func(a, b float64) float64 { return a + b })
+}
+func (vm *VM) opSubC() {
+	vm.arith("SUBC", true, subInt, func(a, b float64) float64 { return a - b })
+}
+func (vm *VM) opMulC() {
+	vm.arith("MULC", true, mulInt, func(a, b float64) float64 { return a * b })
+}
+
+func (vm *VM) opNeg() {
+	vm.unary("NEG", negInt, func(a float64) float64 { return -a })
+}
+func (vm *VM) opAbs() {
+	vm.unary("ABS", absInt, math.Abs)
+}
+
+func (vm *VM) opAnd() {
+	vm.bitwise("AND", func(a, b int64) int64 { return a & b })
+}
+func (vm *VM) opOr() {
+	vm.bitwise("OR", func(a, b int64) int64 { return a | b })
+}
+func (vm *VM) opXor() {
+	vm.bitwise("XOR", func(a, b int64) int64 { return a ^ b })
+}
+func (vm *VM) opNot() {
+	vm.unary("NOT", func(a int64) (int64, bool) { return ^a, false }, nil)
+}
+
+// Shifts move the value below TOS by TOS bits. SHR fills with zeros and SAR
+// with copies of the sign bit.
+func (vm *VM) opShl() {
+	vm.shift("SHL", func(a int64, n uint64) int64 { return a << n })
+}
+func (vm *VM) opShr() {
+	vm.shift("SHR", func(a int64, n uint64) int64 { return int64(uint64(a) >> n) })
+}
+func (vm *VM) opSar() {
+	vm.shift("SAR", func(a int64, n uint64) int64 { return a >> n })
+}
+
+// arith pops two numbers and pushes the result of an operation on them. Two
+// integers give an integer, if either is a float both are used as floats.
+// Integer overflow wraps unless checked is set.
+func (vm *VM) arith(name string, checked bool, ints intOp, floats func(a, b float64) float64) {
 	right := vm.popStack()
-	if right.t != regInt {
-		vm.errorMsg = "ADD only works on integers"
+	left := vm.popStack()
+	if vm.err != nil {
 		return
 	}
 
-	left := vm.popStack()
-	if right.t != regInt {
-		vm.errorMsg = "ADD only works on integers"
+	if !left.isNumber() || !right.isNumber() {
+		vm.fault(ErrTypeMismatch, "%s only works on numbers", name)
 		return
 	}
 
-	vm.pushStackI(left.iVal + right.iVal)
-}
-func (vm *VM) opSub() {
-	right := vm.popStack()
-	if right.t != regInt {
-		vm.errorMsg = "SUB only works on integers"
+	if left.t == regInt && right.t == regInt {
+		if right.iVal == 0 && (name == "DIV" || name == "MOD") {
+			vm.fault(ErrDivideByZero, "%s of %d by zero", name, left.iVal)
+			return
+		}
+
+		result, overflow := ints(left.iVal, right.iVal)
+		if overflow && checked {
+			vm.fault(ErrOverflow, "%s of %d and %d overflowed", name, left.iVal, right.iVal)
+			return
+		}
+		vm.pushStackI(result)
 		return
 	}
+	vm.pushStackF(floats(left.float(), right.float()))
+}
 
-	left := vm.popStack()
-	if right.t != regInt {
-		vm.errorMsg = "SUB only works on integers"
+// unary replaces TOS with the result of an operation on it. Floats are an
+// error if there's no float operation.
+func (vm *VM) unary(name string, ints func(a int64) (int64, bool), floats func(a float64) float64) {
+	v := vm.popStack()
+	if vm.err != nil {
 		return
 	}
 
-	vm.pushStackI(left.iVal - right.iVal)
+	switch {
+	case v.t == regInt:
+		result, overflow := ints(v.iVal)
+		if overflow && vm.flags.checked {
+			vm.fault(ErrOverflow, "%s of %d overflowed", name, v.iVal)
+			return
+		}
+		vm.pushStackI(result)
+	case v.t == regFloat && floats != nil:
+		vm.pushStackF(floats(v.fVal))
+	case floats != nil:
+		vm.fault(ErrTypeMismatch, "%s only works on numbers", name)
+	default:
+		vm.fault(ErrTypeMismatch, "%s only works on integers", name)
+	}
 }
-func (vm *VM) opMul() {
+
+// bitwise pops two integers and pushes the result of an operation on them
+func (vm *VM) bitwise(name string, op func(a, b int64) int64) {
 	right := vm.popStack()
-	if right.t != regInt {
-		vm.errorMsg = "MUL only works on integers"
+	left := vm.popStack()
+	if vm.err != nil {
 		return
 	}
 
-	left := vm.popStack()
-	if right.t != regInt {
-		vm.errorMsg = "MUL only works on integers"
+	if left.t != regInt || right.t != regInt {
+		vm.fault(ErrTypeMismatch, "%s only works on integers", name)
 		return
 	}
-
-	vm.pushStackI(left.iVal * right.iVal)
+	vm.pushStackI(op(left.iVal, right.iVal))
 }
-func (vm *VM) opDiv() {
+
+func (vm *VM) shift(name string, op func(a int64, n uint64) int64) {
 	right := vm.popStack()
-	if right.t != regInt {
-		vm.errorMsg = "DIV only works on integers"
+	left := vm.popStack()
+	if vm.err != nil {
 		return
 	}
 
-	left := vm.popStack()
-	if right.t != regInt {
-		vm.errorMsg = "DIV only works on integers"
+	if left.t != regInt || right.t != regInt {
+		vm.fault(ErrTypeMismatch, "%s only works on integers", name)
+		return
+	}
+	if right.iVal < 0 {
+		vm.fault(ErrInvalidOperand, "%s can't shift by %d bits", name, right.iVal)
 		return
 	}
+	vm.pushStackI(op(left.iVal, uint64(right.iVal)))
+}
+
+// intOp returns the result of an integer operation, wrapped if it overflowed,
+// and whether it overflowed
+type intOp func(a, b int64) (int64, bool)
+
+func addInt(a, b int64) (int64, bool) {
+	c := a + b
+	return c, (c > a) != (b > 0)
+}
+
+func subInt(a, b int64) (int64, bool) {
+	c := a - b
+	return c, (c < a) != (b > 0)
+}
+
+func mulInt(a, b int64) (int64, bool) {
+	c := a * b
+	if a == 0 || b == 0 {
+		return c, false
+	}
+	return c, c/b != a || (a == math.MinInt64 && b == -1)
+}
+
+// The only quotient that overflows is the smallest integer divided by -1
+func divInt(a, b int64) (int64, bool) {
+	return a / b, a == math.MinInt64 && b == -1
+}
+
+func modInt(a, b int64) (int64, bool) {
+	return a % b, false
+}
+
+func negInt(a int64) (int64, bool) {
+	return -a, a == math.MinInt64
+}
 
-	vm.pushStackI(left.iVal / right.iVal)
+func absInt(a int64) (int64, bool) {
+	if a < 0 {
+		return -a, a == math.MinInt64
+	}
+	return a, false
 }
 
 func (vm *VM) opSetI() {
 	reg := vm.fetch()
-	vm.registers[reg].t = regInt
-	vm.registers[reg].iVal = vm.getInt64()
+	vm.setRegister(reg, &vmValue{t: regInt, iVal: vm.getInt64()})
+}
+
+func (vm *VM) opSetF() {
+	reg := vm.fetch()
+	vm.setRegister(reg, &vmValue{t: regFloat, fVal: vm.getFloat64()})
 }
 
 func (vm *VM) opSetStr() {
 	reg := vm.fetch()
-	vm.registers[reg].t = regStr
-	vm.registers[reg].sVal = vm.fetchString()
+	vm.setRegister(reg, &vmValue{t: regStr, sVal: vm.fetchString()})
 }
 
 func (vm *VM) opJump() {
 	vm.setPC(vm.getInt64())
 }
+
+// tosNumber returns TOS for the jumps that test it, faulting if it isn't a number
+func (vm *VM) tosNumber() *vmValue {
+	v := vm.getTOS()
+	if vm.err != nil {
+		return nil
+	}
+	if !v.isNumber() {
+		vm.fault(ErrTypeMismatch, "only numbers can be compared to 0")
+		return nil
+	}
+	return v
+}
+
 func (vm *VM) opJumpGtz() {
 	next := vm.getInt64()
-	if vm.getTOS().iVal > 0 {
+	if v := vm.tosNumber(); v != nil && v.float() > 0 {
 		vm.setPC(next)
 	}
 }
 func (vm *VM) opJumpLtz() {
 	next := vm.getInt64()
-	if vm.getTOS().iVal < 0 {
+	if v := vm.tosNumber(); v != nil && v.float() < 0 {
 		vm.setPC(next)
 	}
 }
 func (vm *VM) opJumpEq() {
 	next := vm.getInt64()
-	if vm.getTOS().iVal == 0 {
+	if v := vm.tosNumber(); v != nil && v.float() == 0 {
 		vm.setPC(next)
 	}
 }
 func (vm *VM) opJumpNeq() {
 	next := vm.getInt64()
-	if vm.getTOS().iVal != 0 {
+	if v := vm.tosNumber(); v != nil && v.float() != 0 {
 		vm.setPC(next)
 	}
 }
@@ -161,30 +321,55 @@ func (vm *VM) opJumpZNeq() {
 }
 func (vm *VM) opJumpReg() {
 	reg := vm.fetch()
-	vm.setPC(vm.registers[reg].iVal)
+	vm.setRegister(PC, vm.registers[reg])
 }
 
 func (vm *VM) opReturn() {
-	vm.setPC(vm.registers[RT].iVal) // Set program counter to return location
+	if vm.flags.legacyCalls || len(vm.frames) == 0 {
+		vm.setRegister(PC, vm.registers[RT]) // Set program counter to return location
+		return
+	}
+
+	f := vm.frames[len(vm.frames)-1]
+	vm.frames = vm.frames[:len(vm.frames)-1]
+
+	*vm.registers[FP] = vmValue{t: regInt, iVal: f.fp} // Restore the caller's frame pointer
+	if len(vm.frames) > 0 {
+		*vm.registers[RT] = vmValue{t: regInt, iVal: vm.frames[len(vm.frames)-1].ret} // Restore the caller's return address
+	}
+	vm.setPC(f.ret)
 }
 func (vm *VM) opCall() {
-	fn := vm.getInt64()                           // Entry address
-	cpc := vm.getPC()                             // Current program counter
-	vm.registers[RT].iVal = cpc                   // Set return address into return address register
-	vm.registers[FP].iVal = vm.registers[SP].iVal // Set the frame pointer to the current stack pointer
-	vm.setPC(fn)                                  // Set program counter to function entrypoint
+	fn := vm.getInt64() // Entry address
+	cpc := vm.getPC()   // Current program counter
+
+	if !vm.flags.legacyCalls {
+		if len(vm.frames) >= maxCallDepth {
+			vm.fault(ErrStackOverflow, "call stack is full, depth %d", len(vm.frames))
+			return
+		}
+		vm.frames = append(vm.frames, frame{
+			ret:   cpc,
+			fp:    vm.registers[FP].iVal,
+			entry: fn,
+		})
+	}
+
+	*vm.registers[RT] = vmValue{t: regInt, iVal: cpc}                   // Set return address into return address register
+	*vm.registers[FP] = vmValue{t: regInt, iVal: vm.registers[SP].iVal} // Set the frame pointer to the current stack pointer
+	vm.setPC(fn)                                                        // Set program counter to function entrypoint
 }
 
 func (vm *VM) opConcat() {
 	right := vm.popStack()
 	if right.t != regStr {
-		vm.errorMsg = "CONCAT only works on strings"
+		vm.fault(ErrTypeMismatch, "CONCAT only works on strings")
 		return
 	}
 
 	left := vm.popStack()
-	if right.t != regStr {
-		vm.errorMsg = "CONCAT only works on strings"
+	if left.t != regStr {
+		vm.fault(ErrTypeMismatch, "CONCAT only works on strings")
 		return
 	}
 
@@ -195,47 +380,454 @@ func (vm *VM) opConcat() {
 	vm.pushStackStr(new)
 }
 
+func (vm *VM) opLen() {
+	str, ok := vm.popStr("LEN")
+	if ok {
+		vm.pushStackI(int64(len(str)))
+	}
+}
+
+// opSubStr replaces a string, start, and length with the bytes of the string
+// from start
+func (vm *VM) opSubStr() {
+	length, ok1 := vm.popInt("SUBSTR", "length")
+	start, ok2 := vm.popInt("SUBSTR", "start")
+	str, ok3 := vm.popStr("SUBSTR")
+	if !ok1 || !ok2 || !ok3 {
+		return
+	}
+
+	if start < 0 || length < 0 || start > int64(len(str)) || length > int64(len(str))-start {
+		vm.fault(ErrOutOfBounds, "SUBSTR of %d bytes from %d is outside a string of length %d", length, start, len(str))
+		return
+	}
+	vm.pushStackStr(str[start : start+length])
+}
+
+// opIndexOf pushes the position of TOS in the string below it, or -1
+func (vm *VM) opIndexOf() {
+	sub, ok1 := vm.popStr("INDEXOF")
+	str, ok2 := vm.popStr("INDEXOF")
+	if ok1 && ok2 {
+		vm.pushStackI(int64(bytes.Index(str, sub)))
+	}
+}
+
+func (vm *VM) opCharAt() {
+	i, ok1 := vm.popInt("CHARAT", "index")
+	str, ok2 := vm.popStr("CHARAT")
+	if !ok1 || !ok2 {
+		return
+	}
+
+	if i < 0 || i >= int64(len(str)) {
+		vm.fault(ErrOutOfBounds, "CHARAT index %d is outside a string of length %d", i, len(str))
+		return
+	}
+	vm.pushStackStr(str[i : i+1])
+}
+
+func (vm *VM) opUpper() {
+	str, ok := vm.popStr("UPPER")
+	if ok {
+		vm.pushStackStr(bytes.ToUpper(str))
+	}
+}
+func (vm *VM) opLower() {
+	str, ok := vm.popStr("LOWER")
+	if ok {
+		vm.pushStackStr(bytes.ToLower(str))
+	}
+}
+func (vm *VM) opTrim() {
+	str, ok := vm.popStr("TRIM")
+	if ok {
+		vm.pushStackStr(bytes.TrimSpace(str))
+	}
+}
+
+// opSplit replaces a string and a separator with the parts of the string
+// followed by the number of parts. The parts are pushed last first so the
+// first part is popped first.
+func (vm *VM) opSplit() {
+	sep, ok1 := vm.popStr("SPLIT")
+	str, ok2 := vm.popStr("SPLIT")
+	if !ok1 || !ok2 {
+		return
+	}
+
+	parts := bytes.Split(str, sep)
+	for i := len(parts) - 1; i >= 0; i-- {
+		vm.pushStackStr(parts[i])
+	}
+	vm.pushStackI(int64(len(parts)))
+}
+
+func (vm *VM) opIToA() {
+	v := vm.popStack()
+	if vm.err != nil {
+		return
+	}
+	if v.t != regInt {
+		vm.fault(ErrTypeMismatch, "ITOA only works on integers")
+		return
+	}
+	vm.pushStackStr(strconv.AppendInt(nil, v.iVal, 10))
+}
+
+func (vm *VM) opAToI() {
+	str, ok := vm.popStr("ATOI")
+	if !ok {
+		return
+	}
+
+	i, err := strconv.ParseInt(string(str), 10, 64)
+	if err != nil {
+		vm.fault(ErrConversion, "%q can't be converted to an integer", str)
+		return
+	}
+	vm.pushStackI(i)
+}
+
+// opNewArr replaces a length with an array of that many zeros
+func (vm *VM) opNewArr() {
+	n, ok := vm.popInt("NEWARR", "length")
+	if !ok {
+		return
+	}
+	if n < 0 || n > maxArrayLen {
+		vm.fault(ErrInvalidOperand, "NEWARR can't make an array of length %d", n)
+		return
+	}
+
+	if !vm.allocItems("NEWARR", n) {
+		return
+	}
+
+	vm.pushStack(&vmValue{t: regArr, aVal: &array{items: make([]*vmValue, n)}})
+}
+
+// opAppend adds TOS to the end of the array below it, leaving the array on
+// the stack
+func (vm *VM) opAppend() {
+	v := vm.popStack()
+	arr, ok := vm.popArr("APPEND")
+	if !ok {
+		return
+	}
+	if len(arr.aVal.items) == maxArrayLen {
+		vm.fault(ErrInvalidOperand, "APPEND can't grow an array past %d items", maxArrayLen)
+		return
+	}
+	if !vm.storable("APPEND", arr, v) || !vm.allocItems("APPEND", 1) {
+		return
+	}
+
+	arr.aVal.items = append(arr.aVal.items, v.dup())
+	vm.pushStack(arr)
+}
+
+// opGetIdx replaces an array and an index with the item at the index
+func (vm *VM) opGetIdx() {
+	i, ok1 := vm.popInt("GETIDX", "index")
+	arr, ok2 := vm.popArr("GETIDX")
+	if !ok1 || !ok2 || !vm.checkIndex("GETIDX", arr, i) {
+		return
+	}
+	if item := arr.aVal.items[i]; item != nil {
+		vm.pushStack(item)
+	} else {
+		vm.pushStackI(0)
+	}
+}
+
+// opSetIdx pops an array, an index, and a value and sets the item at the
+// index to the value, leaving the array on the stack
+func (vm *VM) opSetIdx() {
+	v := vm.popStack()
+	i, ok1 := vm.popInt("SETIDX", "index")
+	arr, ok2 := vm.popArr("SETIDX")
+	if !ok1 || !ok2 || !vm.checkIndex("SETIDX", arr, i) || !vm.storable("SETIDX", arr, v) {
+		return
+	}
+
+	arr.aVal.items[i] = v.dup()
+	vm.pushStack(arr)
+}
+
+func (vm *VM) opArrLen() {
+	arr, ok := vm.popArr("ARRLEN")
+	if ok {
+		vm.pushStackI(int64(len(arr.aVal.items)))
+	}
+}
+
+// allocItems counts n new array items against the heap limit, faulting if
+// they'd go over it
+func (vm *VM) allocItems(name string, n int64) bool {
+	if vm.heapLimit > 0 && n > vm.heapLimit-vm.heapUsed {
+		vm.fault(ErrOutOfMemory, "%s can't make %d more array items, %d of %d are used", name, n, vm.heapUsed, vm.heapLimit)
+		return false
+	}
+	vm.heapUsed += n
+	return true
+}
+
+func (vm *VM) checkIndex(name string, arr *vmValue, i int64) bool {
+	if i < 0 || i >= int64(len(arr.aVal.items)) {
+		vm.fault(ErrOutOfBounds, "%s index %d is outside an array of length %d", name, i, len(arr.aVal.items))
+		return false
+	}
+	return true
+}
+
+// storable faults if putting v in arr would make an array contain itself,
+// which PRINT could never finish printing
+func (vm *VM) storable(name string, arr, v *vmValue) bool {
+	if v.t == regArr && v.aVal.contains(arr.aVal) {
+		vm.fault(ErrInvalidOperand, "%s can't put an array inside itself", name)
+		return false
+	}
+	return true
+}
+
+// popArr pops an array, faulting if TOS isn't one
+func (vm *VM) popArr(name string) (*vmValue, bool) {
+	v := vm.popStack()
+	if vm.err != nil {
+		return nil, false
+	}
+	if v.t != regArr {
+		vm.fault(ErrTypeMismatch, "%s only works on arrays", name)
+		return nil, false
+	}
+	return v, true
+}
+
+// popStr pops a string, faulting if TOS isn't one
+func (vm *VM) popStr(name string) ([]byte, bool) {
+	v := vm.popStack()
+	if vm.err != nil {
+		return nil, false
+	}
+	if v.t != regStr {
+		vm.fault(ErrTypeMismatch, "%s only works on strings", name)
+		return nil, false
+	}
+	return v.sVal, true
+}
+
+// popInt pops an integer operand, faulting if TOS isn't one
+func (vm *VM) popInt(name, operand string) (int64, bool) {
+	v := vm.popStack()
+	if vm.err != nil {
+		return 0, false
+	}
+	if v.t != regInt {
+		vm.fault(ErrTypeMismatch, "%s %s must be an integer", name, operand)
+		return 0, false
+	}
+	return v.iVal, true
+}
+
 func (vm *VM) opParam() {
 	reg := vm.fetch()
 	offset := vm.getInt64()
-	val := vm.stack[vm.registers[FP].iVal-offset]
-	vm.registers[reg] = val.dup()
+	slot := vm.registers[FP].iVal - offset
+	if slot < 0 || slot >= vm.registers[SP].iVal || slot >= int64(len(vm.stack)) {
+		vm.fault(ErrStackUnderflow, "parameter %d is outside the stack, depth %d", offset, vm.registers[SP].iVal)
+		return
+	}
+	vm.setRegister(reg, vm.stack[slot])
 }
 
 func (vm *VM) opCompare() {
-	reg1 := vm.registers[vm.fetch()].iVal
-	reg2 := vm.registers[vm.fetch()].iVal
-	if reg1 > reg2 {
-		vm.flags.zero = 1
-	} else if reg1 < reg2 {
-		vm.flags.zero = -1
+	reg1 := vm.registers[vm.fetch()]
+	reg2 := vm.registers[vm.fetch()]
+
+	order := compare(reg1, reg2)
+	if order == unordered {
+		order = 1 // Never equal
+	}
+	vm.flags.zero = int8(order)
+}
+
+// The comparisons only test for the orders they accept so values which are
+// unordered are only ever not equal
+func (vm *VM) opEq() {
+	vm.compareStack("EQ", false, func(order int) bool { return order == 0 })
+}
+func (vm *VM) opNe() {
+	vm.compareStack("NE", false, func(order int) bool { return order != 0 })
+}
+func (vm *VM) opLt() {
+	vm.compareStack("LT", true, func(order int) bool { return order == -1 })
+}
+func (vm *VM) opLe() {
+	vm.compareStack("LE", true, func(order int) bool { return order == -1 || order == 0 })
+}
+func (vm *VM) opGt() {
+	vm.compareStack("GT", true, func(order int) bool { return order == 1 })
+}
+func (vm *VM) opGe() {
+	vm.compareStack("GE", true, func(order int) bool { return order == 1 || order == 0 })
+}
+
+// compareStack pops two values and pushes 1 if test accepts their order or 0
+// if it doesn't
+func (vm *VM) compareStack(name string, ordered bool, test func(order int) bool) {
+	right := vm.popStack()
+	left := vm.popStack()
+	if vm.err != nil {
+		return
+	}
+
+	if ordered && !canOrder(left, right) {
+		vm.fault(ErrTypeMismatch, "%s can't compare %s and %s", name, left.export().Type, right.export().Type)
+		return
+	}
+
+	if test(compare(left, right)) {
+		vm.pushStackI(1)
 	} else {
-		vm.flags.zero = 0
+		vm.pushStackI(0)
 	}
 }
 
+// canOrder reports whether two values can be compared by LT, LE, GT and GE
+func canOrder(a, b *vmValue) bool {
+	return a.isNumber() && b.isNumber() || a.t == regStr && b.t == regStr
+}
+
+// unordered is the order of values which can't be compared, such as NaN
+const unordered = 2
+
+// compare returns -1 if a is less than b, 0 if they're equal, 1 if a is
+// greater, or unordered. Numbers compare by value and strings byte by byte.
+func compare(a, b *vmValue) int {
+	switch {
+	case a.t == regInt && b.t == regInt:
+		switch {
+		case a.iVal < b.iVal:
+			return -1
+		case a.iVal > b.iVal:
+			return 1
+		}
+		return 0
+	case a.isNumber() && b.isNumber():
+		f1, f2 := a.float(), b.float()
+		switch {
+		case f1 < f2:
+			return -1
+		case f1 > f2:
+			return 1
+		case f1 == f2:
+			return 0
+		}
+	case a.t == regStr && b.t == regStr:
+		return bytes.Compare(a.sVal, b.sVal)
+	case a.t == regArr && b.t == regArr && a.aVal == b.aVal:
+		return 0 // Arrays are only equal to themselves
+	}
+	return unordered
+}
+
+func (vm *VM) opIToF() {
+	v := vm.popStack()
+	if vm.err != nil {
+		return
+	}
+	if v.t != regInt {
+		vm.fault(ErrTypeMismatch, "ITOF only works on integers")
+		return
+	}
+	vm.pushStackF(float64(v.iVal))
+}
+
+func (vm *VM) opFToI() {
+	v := vm.popStack()
+	if vm.err != nil {
+		return
+	}
+	if v.t != regFloat {
+		vm.fault(ErrTypeMismatch, "FTOI only works on floats")
+		return
+	}
+
+	// Every float in this range truncates to an int64
+	if !(v.fVal > -9223372036854775809.0 && v.fVal < 9223372036854775808.0) {
+		vm.fault(ErrConversion, "%s can't be converted to an integer", formatFloat(v.fVal))
+		return
+	}
+	vm.pushStackI(int64(v.fVal))
+}
+
 func (vm *VM) getInt64() int64 {
-	buf := make([]byte, 8)
-	buf[0] = vm.fetch()
-	buf[1] = vm.fetch()
-	buf[2] = vm.fetch()
-	buf[3] = vm.fetch()
-	buf[4] = vm.fetch()
-	buf[5] = vm.fetch()
-	buf[6] = vm.fetch()
-	buf[7] = vm.fetch()
-
-	i, _ := binary.Varint(buf)
-	return i
+	if vm.flags.isa1 {
+		return vm.getInt64V1()
+	}
+	pc := vm.registers[PC].iVal
+	if pc < 0 || pc > int64(len(vm.program))-8 {
+		vm.endOfProgram()
+		return 0
+	}
+	vm.registers[PC].iVal = pc + 8
+	return int64(binary.LittleEndian.Uint64(vm.program[pc:]))
+}
+
+func (vm *VM) getFloat64() float64 {
+	return math.Float64frombits(uint64(vm.getInt64()))
 }
 
 func (vm *VM) fetchString() []byte {
-	l := (int16(vm.fetch()) << 8) + int16(vm.fetch())
-	str := make([]byte, l)
+	if vm.flags.isa1 {
+		return vm.fetchStringV1()
+	}
+	pc := vm.registers[PC].iVal
+	if pc < 0 || pc > int64(len(vm.program))-4 {
+		vm.endOfProgram()
+		return nil
+	}
+
+	l := int64(binary.LittleEndian.Uint32(vm.program[pc:]))
+	pc += 4
+	if l > int64(len(vm.program))-pc {
+		vm.fault(ErrEndOfProgram, "string of length %d runs past the end of the program", l)
+		return nil
+	}
+
+	vm.registers[PC].iVal = pc + l
+	return vm.program[pc : pc+l : pc+l]
+}
+
+// getInt64V1 and fetchStringV1 read operands encoded by version 1 of the
+// instruction set: integers as varints padded to 8 bytes and string lengths
+// as 2 byte big endian values.
+func (vm *VM) getInt64V1() int64 {
+	pc := vm.registers[PC].iVal
+	if pc < 0 || pc > int64(len(vm.program))-8 {
+		vm.endOfProgram()
+		return 0
+	}
+	vm.registers[PC].iVal = pc + 8
+	i, _ := binary.Varint(vm.program[pc : pc+8])
+	return i
+}
+
+func (vm *VM) fetchStringV1() []byte {
+	pc := vm.registers[PC].iVal
+	if pc < 0 || pc > int64(len(vm.program))-2 {
+		vm.endOfProgram()
+		return nil
+	}
 
-	for i := int16(0); i < l; i++ {
-		str[i] = vm.fetch()
+	l := int64((int16(vm.program[pc]) << 8) + int16(vm.program[pc+1]))
+	pc += 2
+	if l < 0 || l > int64(len(vm.program))-pc {
+		vm.fault(ErrEndOfProgram, "string of length %d runs past the end of the program", l)
+		return nil
 	}
 
-	return str
+	vm.registers[PC].iVal = pc + l
+	return vm.program[pc : pc+l : pc+l]
 }
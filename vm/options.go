@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"bufio"
+	"io"
+)
+
+// Option configures a VM when it's created
+type Option func(*VM)
+
+// WithDebug enables printing each bytecode as it's executed
+func WithDebug(debug bool) Option {
+	return func(vm *VM) {
+		vm.flags.debug = debug
+	}
+}
+
+// WithLegacyCalls makes CALL and RETURN behave as they did before the VM
+// kept a call stack. CALL overwrites $RT and $FP and RETURN jumps to $RT,
+// programs must save and restore them when making nested calls.
+func WithLegacyCalls() Option {
+	return func(vm *VM) {
+		vm.flags.legacyCalls = true
+	}
+}
+
+// WithCheckedArithmetic makes integer ADD, SUB, MUL, DIV, NEG and ABS fault
+// when the result overflows instead of wrapping around
+func WithCheckedArithmetic() Option {
+	return func(vm *VM) {
+		vm.flags.checked = true
+	}
+}
+
+// WithHeapLimit limits how many array items a program can make. Every item
+// made by NEWARR, APPEND and host functions counts, even once its array is
+// no longer used. Going over the limit faults with ErrOutOfMemory. 0 means
+// no limit.
+func WithHeapLimit(items int64) Option {
+	return func(vm *VM) {
+		vm.heapLimit = items
+	}
+}
+
+// WithStdin sets the reader used for debugger input
+func WithStdin(r io.Reader) Option {
+	return func(vm *VM) {
+		vm.stdin = bufio.NewReader(r)
+	}
+}
+
+// WithStdout sets the writer used for program output such as PRINT and DUMP
+func WithStdout(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.stdout = w
+	}
+}
+
+// WithStderr sets the writer used for debug output and the step debugger
+func WithStderr(w io.Writer) Option {
+	return func(vm *VM) {
+		vm.stderr = w
+	}
+}
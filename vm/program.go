@@ -0,0 +1,324 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Compiled file layout. All integers are big endian.
+//
+//	magic          [4]byte  0x1F 'E' 'B' 'C'
+//	marker         byte     0xFF, not a valid opcode so legacy files can be told apart
+//	format version uint16
+//	ISA version    uint16
+//	entry address  int64
+//	section count  uint16
+//	sections       section count * (id byte, length uint32, data [length]byte)
+//
+// Legacy files are the magic followed directly by the program code.
+const (
+	// FormatVersion is the version of the compiled file layout
+	FormatVersion uint16 = 1
+	// ISAVersion is the version of the instruction set and operand encoding.
+	// Version 1 encoded integers as varints padded to 8 bytes and string
+	// lengths as 2 byte big endian values. Version 2 encodes integers as
+	// 8 byte little endian values and string lengths as 4 byte little endian
+	// values. Version 1 programs are run with their own encoding.
+	ISAVersion uint16 = 2
+
+	formatMarker = 0xFF
+)
+
+// FileMagic is the first four bytes of every compiled file
+var FileMagic = []byte{31, 'E', 'B', 'C'}
+
+// Section IDs
+const (
+	sectionCode      byte = 0x01
+	sectionConstants byte = 0x02
+	sectionSymbols   byte = 0x03
+	sectionLines     byte = 0x04
+	sectionRelocs    byte = 0x05
+)
+
+// LineEntry maps the address of an instruction to the source line it came from
+type LineEntry struct {
+	Addr int64
+	Line int
+}
+
+// Program is an assembled program along with the information needed to run and debug it
+type Program struct {
+	FormatVersion uint16 // 0 for legacy files
+	ISAVersion    uint16
+	Entry         int64 // Address execution starts from
+
+	Code      []byte
+	Constants [][]byte         // String constants referenced by the program
+	Symbols   map[string]int64 // Label addresses
+	Source    string           // Name of the source the line table refers to
+	Lines     []LineEntry      // Sorted by address
+	Relocs    []int64          // Addresses of operands that hold a label's address
+}
+
+// NewProgram wraps raw bytecode in a Program with no debug information
+func NewProgram(code []byte) *Program {
+	return &Program{
+		FormatVersion: FormatVersion,
+		ISAVersion:    ISAVersion,
+		Code:          code,
+		Symbols:       make(map[string]int64),
+	}
+}
+
+// IsCompiled reports if data starts with the compiled file magic
+func IsCompiled(data []byte) bool {
+	return bytes.HasPrefix(data, FileMagic)
+}
+
+// LineFor returns the source line of the instruction at addr, or 0 if it's unknown
+func (p *Program) LineFor(addr int64) int {
+	i := sort.Search(len(p.Lines), func(i int) bool { return p.Lines[i].Addr > addr })
+	if i == 0 {
+		return 0
+	}
+	return p.Lines[i-1].Line
+}
+
+// MarshalBinary encodes the program as a compiled file
+func (p *Program) MarshalBinary() ([]byte, error) {
+	var out bytes.Buffer
+	out.Write(FileMagic)
+	out.WriteByte(formatMarker)
+	writeBE(&out, FormatVersion)
+	writeBE(&out, p.ISAVersion)
+	writeBE(&out, p.Entry)
+	writeBE(&out, uint16(5))
+
+	writeSection(&out, sectionCode, p.Code)
+
+	var consts bytes.Buffer
+	writeBE(&consts, uint32(len(p.Constants)))
+	for _, c := range p.Constants {
+		writeBE(&consts, uint32(len(c)))
+		consts.Write(c)
+	}
+	writeSection(&out, sectionConstants, consts.Bytes())
+
+	var syms bytes.Buffer
+	names := make([]string, 0, len(p.Symbols))
+	for name := range p.Symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeBE(&syms, uint32(len(names)))
+	for _, name := range names {
+		if len(name) > 0xFFFF {
+			return nil, fmt.Errorf("Symbol name too long: %s", name[:32])
+		}
+		writeBE(&syms, uint16(len(name)))
+		syms.WriteString(name)
+		writeBE(&syms, p.Symbols[name])
+	}
+	writeSection(&out, sectionSymbols, syms.Bytes())
+
+	var lines bytes.Buffer
+	writeBE(&lines, uint16(len(p.Source)))
+	lines.WriteString(p.Source)
+	writeBE(&lines, uint32(len(p.Lines)))
+	for _, entry := range p.Lines {
+		writeBE(&lines, entry.Addr)
+		writeBE(&lines, uint32(entry.Line))
+	}
+	writeSection(&out, sectionLines, lines.Bytes())
+
+	var relocs bytes.Buffer
+	writeBE(&relocs, uint32(len(p.Relocs)))
+	for _, addr := range p.Relocs {
+		writeBE(&relocs, addr)
+	}
+	writeSection(&out, sectionRelocs, relocs.Bytes())
+
+	return out.Bytes(), nil
+}
+
+// ReadProgram decodes a compiled file. Legacy files, which contain only
+// the magic and code, are loaded with a format version of 0.
+func ReadProgram(data []byte) (*Program, error) {
+	if !IsCompiled(data) {
+		return nil, errors.New("Not a compiled bytecode file")
+	}
+	data = data[len(FileMagic):]
+
+	if len(data) == 0 || data[0] != formatMarker {
+		p := NewProgram(data)
+		p.FormatVersion = 0
+		p.ISAVersion = 1 // Legacy files predate version 2 operands
+		return p, nil
+	}
+
+	r := bytes.NewReader(data[1:])
+	p := NewProgram(nil)
+	var sections uint16
+	if err := readBE(r, &p.FormatVersion, &p.ISAVersion, &p.Entry, &sections); err != nil {
+		return nil, err
+	}
+
+	if p.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("Unsupported file format version %d", p.FormatVersion)
+	}
+	if p.ISAVersion > ISAVersion {
+		return nil, fmt.Errorf("Unsupported instruction set version %d", p.ISAVersion)
+	}
+
+	for i := uint16(0); i < sections; i++ {
+		var id byte
+		var length uint32
+		if err := readBE(r, &id, &length); err != nil {
+			return nil, err
+		}
+		if int64(length) > int64(r.Len()) {
+			return nil, errors.New("Truncated bytecode file")
+		}
+
+		section := make([]byte, length)
+		r.Read(section)
+
+		var err error
+		switch id {
+		case sectionCode:
+			p.Code = section
+		case sectionConstants:
+			err = p.readConstants(bytes.NewReader(section))
+		case sectionSymbols:
+			err = p.readSymbols(bytes.NewReader(section))
+		case sectionLines:
+			err = p.readLines(bytes.NewReader(section))
+		case sectionRelocs:
+			err = p.readRelocs(bytes.NewReader(section))
+		default:
+			// Unknown sections are skipped so newer files still load
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Program) readConstants(r *bytes.Reader) error {
+	var count uint32
+	if err := readBE(r, &count); err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var length uint32
+		if err := readBE(r, &length); err != nil {
+			return err
+		}
+		if int64(length) > int64(r.Len()) {
+			return errors.New("Truncated constant section")
+		}
+
+		c := make([]byte, length)
+		r.Read(c)
+		p.Constants = append(p.Constants, c)
+	}
+	return nil
+}
+
+func (p *Program) readSymbols(r *bytes.Reader) error {
+	var count uint32
+	if err := readBE(r, &count); err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var length uint16
+		if err := readBE(r, &length); err != nil {
+			return err
+		}
+		if int(length) > r.Len() {
+			return errors.New("Truncated symbol section")
+		}
+
+		name := make([]byte, length)
+		r.Read(name)
+
+		var addr int64
+		if err := readBE(r, &addr); err != nil {
+			return err
+		}
+		p.Symbols[string(name)] = addr
+	}
+	return nil
+}
+
+func (p *Program) readLines(r *bytes.Reader) error {
+	var length uint16
+	if err := readBE(r, &length); err != nil {
+		return err
+	}
+	if int(length) > r.Len() {
+		return errors.New("Truncated line section")
+	}
+
+	source := make([]byte, length)
+	r.Read(source)
+	p.Source = string(source)
+
+	var count uint32
+	if err := readBE(r, &count); err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var addr int64
+		var line uint32
+		if err := readBE(r, &addr, &line); err != nil {
+			return err
+		}
+		p.Lines = append(p.Lines, LineEntry{Addr: addr, Line: int(line)})
+	}
+	return nil
+}
+
+func (p *Program) readRelocs(r *bytes.Reader) error {
+	var count uint32
+	if err := readBE(r, &count); err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var addr int64
+		if err := readBE(r, &addr); err != nil {
+			return err
+		}
+		p.Relocs = append(p.Relocs, addr)
+	}
+	return nil
+}
+
+func writeSection(out *bytes.Buffer, id byte, data []byte) {
+	out.WriteByte(id)
+	writeBE(out, uint32(len(data)))
+	out.Write(data)
+}
+
+func writeBE(out *bytes.Buffer, v interface{}) {
+	binary.Write(out, binary.BigEndian, v)
+}
+
+func readBE(r *bytes.Reader, vs ...interface{}) error {
+	for _, v := range vs {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return errors.New("Truncated bytecode file")
+		}
+	}
+	return nil
+}
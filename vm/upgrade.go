@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// SETIOperands is how Upgrade treats SETI operands of programs without
+// relocation information, which can't say which operands are labels.
+type SETIOperands uint8
+
+const (
+	// SETIAmbiguous fails the upgrade if a SETI operand could be a label
+	SETIAmbiguous SETIOperands = iota
+	// SETILabels treats SETI operands that are the address of an instruction as labels
+	SETILabels
+	// SETIValues treats every SETI operand as a value
+	SETIValues
+)
+
+// AmbiguousError lists the SETI operands an upgrade couldn't decide were labels or values
+type AmbiguousError struct {
+	Addrs []int64 // Addresses of the SETI instructions
+}
+
+func (e *AmbiguousError) Error() string {
+	addrs := make([]string, len(e.Addrs))
+	for i, addr := range e.Addrs {
+		addrs[i] = fmt.Sprintf("0x%X", addr)
+	}
+	return fmt.Sprintf("SETI operands at %s could be labels or values", strings.Join(addrs, ", "))
+}
+
+// Upgrade rewrites the program's code to the current operand encoding.
+// Addresses in operands, symbols, the line table and relocations are moved
+// to match the new code. Programs already using the current encoding are
+// left as they are.
+//
+// A SETI operand of a program without relocation information is ambiguous
+// if it's the address of an instruction that moves. seti says what to do
+// with them, by default an *AmbiguousError is returned and the program is
+// left as it was.
+func (p *Program) Upgrade(seti SETIOperands) error {
+	if p.ISAVersion == ISAVersion {
+		return nil
+	}
+	if p.ISAVersion != 1 {
+		return fmt.Errorf("Can't upgrade instruction set version %d", p.ISAVersion)
+	}
+
+	var insts []Instruction
+	moved := make(map[int64]int64) // Old address to new address
+	newAddr := int64(0)
+
+	for addr := int64(0); addr < int64(len(p.Code)); {
+		inst, err := p.Decode(addr)
+		if err != nil {
+			return fmt.Errorf("Can't upgrade program: %s", err)
+		}
+
+		moved[addr] = newAddr
+		newAddr += inst.Size
+		for _, op := range inst.Operands {
+			if op.Kind == OperandStr {
+				newAddr += 2 // String lengths grow from 2 to 4 bytes
+			}
+		}
+
+		insts = append(insts, inst)
+		addr += inst.Size
+	}
+	moved[int64(len(p.Code))] = newAddr
+
+	move := func(addr int64) int64 {
+		if n, ok := moved[addr]; ok {
+			return n
+		}
+		return addr // Not an instruction, the verifier will report it
+	}
+
+	relocs := make(map[int64]bool, len(p.Relocs))
+	for _, addr := range p.Relocs {
+		relocs[addr] = true
+	}
+	isLabel := func(op Operand) bool {
+		if op.Kind != OperandIntOrAddr || len(p.Relocs) > 0 {
+			return relocs[op.Addr]
+		}
+		return seti == SETILabels && move(op.Int) != op.Int
+	}
+
+	if len(p.Relocs) == 0 && seti == SETIAmbiguous {
+		var ambiguous []int64
+		for _, inst := range insts {
+			for _, op := range inst.Operands {
+				if op.Kind != OperandIntOrAddr {
+					continue
+				}
+				if n, ok := moved[op.Int]; ok && n != op.Int {
+					ambiguous = append(ambiguous, inst.Addr)
+				}
+			}
+		}
+		if len(ambiguous) > 0 {
+			return &AmbiguousError{Addrs: ambiguous}
+		}
+	}
+
+	var code bytes.Buffer
+	var newRelocs []int64
+	buf := make([]byte, 8)
+
+	for _, inst := range insts {
+		code.WriteByte(inst.Opcode)
+
+		for _, op := range inst.Operands {
+			switch op.Kind {
+			case OperandByte, OperandReg:
+				code.WriteByte(byte(op.Int))
+			case OperandStr:
+				binary.LittleEndian.PutUint32(buf, uint32(len(op.Str)))
+				code.Write(buf[:4])
+				code.Write(op.Str)
+			default:
+				val := op.Int
+				label := isLabel(op)
+
+				if op.Kind == OperandAddr || label {
+					val = move(val)
+				}
+				if label {
+					newRelocs = append(newRelocs, int64(code.Len()))
+				}
+
+				binary.LittleEndian.PutUint64(buf, uint64(val))
+				code.Write(buf)
+			}
+		}
+	}
+
+	p.Code = code.Bytes()
+	p.Entry = move(p.Entry)
+	for name, addr := range p.Symbols {
+		p.Symbols[name] = move(addr)
+	}
+	for i := range p.Lines {
+		p.Lines[i].Addr = move(p.Lines[i].Addr)
+	}
+	p.Relocs = newRelocs
+	p.ISAVersion = ISAVersion
+	return nil
+}
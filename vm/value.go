@@ -0,0 +1,165 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ValueType is the type of a Value
+type ValueType uint8
+
+const (
+	// TypeInt is a 64bit signed integer
+	TypeInt ValueType = iota
+	// TypeStr is a byte string
+	TypeStr
+	// TypeFloat is a 64bit floating point number
+	TypeFloat
+	// TypeArray is a growable array of values
+	TypeArray
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case TypeInt:
+		return "int"
+	case TypeStr:
+		return "string"
+	case TypeFloat:
+		return "float"
+	case TypeArray:
+		return "array"
+	}
+	return "unknown"
+}
+
+// Value is a copy of a register or stack slot that can be used outside the VM
+type Value struct {
+	Type  ValueType
+	Int   int64
+	Str   string
+	Float float64
+	Array []Value
+}
+
+func (v Value) String() string {
+	if v.Type == TypeStr {
+		return fmt.Sprintf("%q", v.Str)
+	}
+	if v.Type == TypeFloat {
+		return formatFloat(v.Float)
+	}
+	if v.Type == TypeArray {
+		items := make([]string, len(v.Array))
+		for i, item := range v.Array {
+			items[i] = item.String()
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprintf("%d", v.Int)
+}
+
+// Equal reports whether two values have the same type and contents. Floats
+// are compared bit for bit, so NaN is equal to itself.
+func (v Value) Equal(o Value) bool {
+	if v.Type != o.Type || v.Int != o.Int || v.Str != o.Str || len(v.Array) != len(o.Array) {
+		return false
+	}
+	if math.Float64bits(v.Float) != math.Float64bits(o.Float) {
+		return false
+	}
+	for i := range v.Array {
+		if !v.Array[i].Equal(o.Array[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Int creates an integer Value
+func Int(i int64) Value {
+	return Value{Type: TypeInt, Int: i}
+}
+
+// Float creates a float Value
+func Float(f float64) Value {
+	return Value{Type: TypeFloat, Float: f}
+}
+
+// Array creates an array Value holding copies of items
+func Array(items ...Value) Value {
+	return Value{Type: TypeArray, Array: append([]Value{}, items...)}
+}
+
+// Str creates a string Value
+func Str(s string) Value {
+	return Value{Type: TypeStr, Str: s}
+}
+
+func importValue(v Value) *vmValue {
+	if v.Type == TypeStr {
+		return &vmValue{t: regStr, sVal: []byte(v.Str)}
+	}
+	if v.Type == TypeFloat {
+		return &vmValue{t: regFloat, fVal: v.Float}
+	}
+	if v.Type == TypeArray {
+		arr := &array{items: make([]*vmValue, len(v.Array))}
+		for i, item := range v.Array {
+			arr.items[i] = importValue(item)
+		}
+		return &vmValue{t: regArr, aVal: arr}
+	}
+	return &vmValue{t: regInt, iVal: v.Int}
+}
+
+func (v *vmValue) export() Value {
+	return v.exportShared(nil)
+}
+
+// exportShared copies v like export, but an array already copied into seen
+// isn't copied again. The copies share their items just as the VM's arrays
+// do, so exporting many references to one array costs as much as one.
+func (v *vmValue) exportShared(seen map[*array][]Value) Value {
+	if v == nil {
+		return Value{}
+	}
+	if v.t == regStr {
+		return Value{Type: TypeStr, Str: string(v.sVal)}
+	}
+	if v.t == regFloat {
+		return Value{Type: TypeFloat, Float: v.fVal}
+	}
+	if v.t == regArr {
+		if items, ok := seen[v.aVal]; ok {
+			return Value{Type: TypeArray, Array: items}
+		}
+
+		items := make([]Value, len(v.aVal.items))
+		if seen != nil {
+			seen[v.aVal] = items
+		}
+		for i, item := range v.aVal.items {
+			if item == nil {
+				items[i] = Int(0)
+				continue
+			}
+			items[i] = item.exportShared(seen)
+		}
+		return Value{Type: TypeArray, Array: items}
+	}
+	return Value{Type: TypeInt, Int: v.iVal}
+}
+
+// items returns how many array items importing v makes
+func (v Value) items() int64 {
+	if v.Type != TypeArray {
+		return 0
+	}
+	n := int64(len(v.Array))
+	for _, item := range v.Array {
+		n += item.items()
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package vm
+
+import "fmt"
+
+// VerifyError describes why a program failed verification
+type VerifyError struct {
+	Addr int64 // Address of the offending instruction
+	Msg  string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("invalid program at 0x%X: %s", e.Addr, e.Msg)
+}
+
+// Verify checks the program can be executed without reading outside of the
+// program or registers. Every instruction must be defined with all of its
+// operands inside the program, register operands must name a register, and
+// jump, call and label targets must be the start of an instruction.
+func (p *Program) Verify() error {
+	_, err := p.verify()
+	return err
+}
+
+// verify returns which addresses are the start of an instruction
+func (p *Program) verify() ([]bool, error) {
+	if p.ISAVersion < 1 || p.ISAVersion > ISAVersion {
+		return nil, &VerifyError{Msg: fmt.Sprintf("unsupported instruction set version %d", p.ISAVersion)}
+	}
+
+	code := p.Code
+	starts := make([]bool, len(code))
+	var insts []Instruction
+
+	for addr := int64(0); addr < int64(len(code)); {
+		inst, err := p.Decode(addr)
+		if err != nil {
+			return nil, &VerifyError{Addr: addr, Msg: err.Error()}
+		}
+
+		for _, op := range inst.Operands {
+			if op.Kind == OperandReg && op.Int >= int64(totalRegisters) {
+				return nil, &VerifyError{Addr: addr, Msg: fmt.Sprintf("0x%X is not a register", op.Int)}
+			}
+		}
+
+		starts[addr] = true
+		insts = append(insts, inst)
+		addr += inst.Size
+	}
+
+	isStart := func(addr int64) bool {
+		return addr >= 0 && addr < int64(len(starts)) && starts[addr]
+	}
+
+	if len(code) > 0 && !isStart(p.Entry) {
+		return nil, &VerifyError{Addr: p.Entry, Msg: "entry address is not an instruction"}
+	}
+
+	relocs := make(map[int64]bool, len(p.Relocs))
+	for _, addr := range p.Relocs {
+		relocs[addr] = true
+	}
+
+	for _, inst := range insts {
+		for _, op := range inst.Operands {
+			if op.Kind != OperandAddr && !relocs[op.Addr] {
+				continue
+			}
+			if !isStart(op.Int) {
+				return nil, &VerifyError{
+					Addr: inst.Addr,
+					Msg:  fmt.Sprintf("%s target 0x%X is not an instruction", inst.Name, op.Int),
+				}
+			}
+		}
+	}
+
+	return starts, nil
+}
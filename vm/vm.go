@@ -3,16 +3,35 @@ package vm
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type regType uint8
 
+// Number of instructions executed between checks of the context passed to Run
+const cancelCheckInterval = 1024
+
+// Maximum number of nested function calls
+const maxCallDepth = 1024
+
+// frame is an entry on the call stack pushed by CALL and popped by RETURN
+type frame struct {
+	ret   int64 // Return address
+	fp    int64 // Caller's frame pointer
+	entry int64 // Address of the called function
+}
+
 const (
 	regInt regType = iota
 	regStr
+	regFloat
+	regArr
 
 	// PC is the current program counter register
 	PC = totalUserRegisters
@@ -29,15 +48,83 @@ const (
 type vmValue struct {
 	t    regType
 	iVal int64
+	fVal float64
 	sVal []byte
+	aVal *array
+}
+
+// array is shared by every value referring to it, so changes made through one
+// are seen by all of them. A nil item is 0, NEWARR leaves every item nil.
+type array struct {
+	items []*vmValue
+}
+
+// maxArrayLen is the most items an array can hold
+const maxArrayLen = 1 << 24
+
+// contains reports whether a is other or holds it at any depth
+func (a *array) contains(other *array) bool {
+	if a == other {
+		return true
+	}
+	for _, item := range a.items {
+		if item != nil && item.t == regArr && item.aVal.contains(other) {
+			return true
+		}
+	}
+	return false
 }
 
 func (v *vmValue) dup() *vmValue {
 	return &vmValue{
 		t:    v.t,
 		iVal: v.iVal,
+		fVal: v.fVal,
 		sVal: v.sVal,
+		aVal: v.aVal,
+	}
+}
+
+func (v *vmValue) isNumber() bool {
+	return v.t == regInt || v.t == regFloat
+}
+
+// float returns a number as a float
+func (v *vmValue) float() float64 {
+	if v.t == regFloat {
+		return v.fVal
 	}
+	return float64(v.iVal)
+}
+
+// format returns the value as PRINT shows it
+func (v *vmValue) format() string {
+	switch v.t {
+	case regStr:
+		return strconv.Quote(string(v.sVal))
+	case regFloat:
+		return formatFloat(v.fVal)
+	case regArr:
+		items := make([]string, len(v.aVal.items))
+		for i, item := range v.aVal.items {
+			if item == nil {
+				items[i] = "0"
+				continue
+			}
+			items[i] = item.format()
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return strconv.FormatInt(v.iVal, 10)
+}
+
+// formatFloat formats a float so it can't be mistaken for an integer
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
 }
 
 type VM struct {
@@ -46,64 +133,143 @@ type VM struct {
 		step   bool
 		noStep bool
 		zero   int8
+
+		legacyCalls bool // CALL and RETURN only use $RT and $FP
+		checked     bool // Integer arithmetic traps on overflow
+		isa1        bool // Operands use the version 1 encoding
 	}
-	errorMsg string
+	err    *RuntimeError
+	opPC   int64  // Address of the instruction being executed
+	starts []bool // Addresses which begin an instruction, set once the program is verified
 
+	prog    *Program
 	program []byte // Bytecode (program)
 
 	registers []*vmValue // General purpose registers
 	stack     []*vmValue // Stack
+	frames    []frame    // Call stack
+
+	hostFuncs map[int64]*hostFunc // Functions callable with SYSCALL
+	hostNames map[int64][]string  // Names in the constant pool by ID, set once the program is verified
+
+	heapLimit int64 // Most array items the program can make, 0 for no limit
+	heapUsed  int64 // Array items made so far
+
+	hooks  []Hook // Called before each instruction
+	onStep Hook   // Replaces the step prompt when a STEP instruction is executed
+
+	stdin  *bufio.Reader // Read by the step debugger
+	stdout io.Writer     // Program output
+	stderr io.Writer     // Debugging output
+}
+
+// New creates a VM for the bytecode program. By default the VM uses the
+// process's standard streams, options can be given to change them.
+func New(in []byte, opts ...Option) *VM {
+	return Load(NewProgram(in), opts...)
 }
 
-func New(in []byte) *VM {
+// Load creates a VM for an assembled or compiled Program. Execution begins at
+// the program's entry address.
+func Load(p *Program, opts ...Option) *VM {
 	vm := &VM{
-		program:   in,
+		prog:      p,
+		program:   p.Code,
 		registers: make([]*vmValue, totalRegisters),
 		stack:     make([]*vmValue, 1024),
+		hostFuncs: make(map[int64]*hostFunc),
+		stdin:     bufio.NewReader(os.Stdin),
+		stdout:    os.Stdout,
+		stderr:    os.Stderr,
 	}
 
 	for i := range vm.registers {
 		vm.registers[i] = &vmValue{}
 	}
 
+	vm.registers[PC].iVal = p.Entry
+
+	for _, opt := range opts {
+		opt(vm)
+	}
+
 	return vm
 }
 
-func (vm *VM) Start(debug bool) byte {
+// Program returns the program being executed
+func (vm *VM) Program() *Program {
+	return vm.prog
+}
+
+// Start executes the program until it halts. The exit code is returned along with
+// a *RuntimeError if the program faulted, in which case the exit code is 1.
+func (vm *VM) Start(debug bool) (byte, error) {
 	vm.flags.debug = debug
+	return vm.Run(context.Background())
+}
+
+// Run executes the program like Start but stops early if ctx is cancelled or its
+// deadline passes. The context is checked every cancelCheckInterval instructions.
+func (vm *VM) Run(ctx context.Context) (byte, error) {
+	if err := vm.Prepare(); err != nil {
+		return 1, err
+	}
+
+	done := ctx.Done()
+	count := 0
 
 	for {
-		if vm.errorMsg != "" {
-			fmt.Println(vm.errorMsg)
-			return 1
+		if vm.err != nil {
+			return 1, vm.err
+		}
+
+		vm.opPC = vm.getPC()
+
+		if done != nil {
+			count++
+			if count == cancelCheckInterval {
+				count = 0
+				if err := ctx.Err(); err != nil {
+					vm.cancelled(err)
+					return 1, vm.err
+				}
+			}
+		}
+
+		if len(vm.hooks) > 0 {
+			for _, hook := range vm.hooks {
+				hook(vm)
+			}
+			if vm.err != nil {
+				return 1, vm.err
+			}
+			vm.opPC = vm.getPC() // A hook may have moved the program counter
 		}
 
 		code := vm.fetch()
+		if vm.err != nil {
+			return 1, vm.err
+		}
 
 		if vm.flags.debug {
-			fmt.Printf("Executing 0x%X\n", code)
+			fmt.Fprintf(vm.stderr, "Executing 0x%X\n", code)
 		}
 
 		if vm.flags.step {
-			vm.printRegisters()
-			fmt.Print("Stack: ")
-			vm.printStack()
-			fmt.Printf("Instruction: %s; Flags: zero = %d\n", instructions[code], vm.flags.zero)
-			fmt.Print("> ")
-			resp, _ := bufio.NewReader(os.Stdin).ReadBytes('\n')
-			if bytes.Equal(resp, []byte("next\n")) {
-				vm.flags.step = false
-			} else if bytes.Equal(resp, []byte("continue\n")) {
-				vm.flags.step = false
-				vm.flags.noStep = true
-			}
+			vm.stepPrompt(code)
 		}
 
 		switch code {
 		case Halt:
-			return vm.fetch()
+			exit := vm.fetch()
+			if vm.err != nil {
+				return 1, vm.err
+			}
+			return exit, nil
 		case Step:
-			if !vm.flags.noStep {
+			if vm.onStep != nil {
+				vm.onStep(vm)
+			} else if !vm.flags.noStep {
 				vm.flags.step = true
 			}
 
@@ -160,23 +326,16 @@ func (vm *VM) Start(debug bool) byte {
 			vm.opJumpReg()
 
 		case Print:
-			tos := vm.getTOS()
-			if tos.t == regInt {
-				fmt.Printf("%d\n", tos.iVal)
-			} else {
-				fmt.Printf("%q\n", tos.sVal)
+			if tos := vm.getTOS(); vm.err == nil {
+				fmt.Fprintln(vm.stdout, tos.format())
 			}
 		case Dump:
-			vm.printStack()
+			vm.printStack(vm.stdout)
 		case PrintR:
 			reg := vm.fetch()
-			if vm.registers[reg].t == regInt {
-				fmt.Printf("%d\n", vm.registers[reg].iVal)
-			} else {
-				fmt.Printf("%q\n", vm.registers[reg].sVal)
-			}
+			fmt.Fprintln(vm.stdout, vm.registers[reg].format())
 		case DumpR:
-			vm.printRegisters()
+			vm.printRegisters(vm.stdout)
 
 		case Return:
 			vm.opReturn()
@@ -192,92 +351,362 @@ func (vm *VM) Start(debug bool) byte {
 		case Compare:
 			vm.opCompare()
 
+		case Syscall:
+			vm.opSyscall()
+
+		case PushF:
+			vm.opPushF()
+		case SetF:
+			vm.opSetF()
+		case IToF:
+			vm.opIToF()
+		case FToI:
+			vm.opFToI()
+
+		case Mod:
+			vm.opMod()
+		case Neg:
+			vm.opNeg()
+		case Abs:
+			vm.opAbs()
+
+		case And:
+			vm.opAnd()
+		case Or:
+			vm.opOr()
+		case Xor:
+			vm.opXor()
+		case Not:
+			vm.opNot()
+		case Shl:
+			vm.opShl()
+		case Shr:
+			vm.opShr()
+		case Sar:
+			vm.opSar()
+
+		case AddC:
+			vm.opAddC()
+		case SubC:
+			vm.opSubC()
+		case MulC:
+			vm.opMulC()
+
+		case Eq:
+			vm.opEq()
+		case Ne:
+			vm.opNe()
+		case Lt:
+			vm.opLt()
+		case Le:
+			vm.opLe()
+		case Gt:
+			vm.opGt()
+		case Ge:
+			vm.opGe()
+
+		case Len:
+			vm.opLen()
+		case SubStr:
+			vm.opSubStr()
+		case IndexOf:
+			vm.opIndexOf()
+		case CharAt:
+			vm.opCharAt()
+		case Upper:
+			vm.opUpper()
+		case Lower:
+			vm.opLower()
+		case Split:
+			vm.opSplit()
+		case Trim:
+			vm.opTrim()
+		case IToA:
+			vm.opIToA()
+		case AToI:
+			vm.opAToI()
+
+		case NewArr:
+			vm.opNewArr()
+		case Append:
+			vm.opAppend()
+		case GetIdx:
+			vm.opGetIdx()
+		case SetIdx:
+			vm.opSetIdx()
+		case ArrLen:
+			vm.opArrLen()
+
 		default:
-			fmt.Printf("Unknown bytecode 0x%X\n", code)
-			return 1
+			vm.fault(ErrUnknownOpcode, "unknown bytecode 0x%X", code)
 		}
 	}
 }
 
+// Prepare verifies the program. It's done by Run if it hasn't been already,
+// it only needs to be called to inspect the program as it will be run before
+// running it. Version 1 programs are run as they are, without being upgraded.
+func (vm *VM) Prepare() error {
+	if vm.starts != nil {
+		return nil
+	}
+	if vm.err != nil {
+		return vm.err
+	}
+
+	starts, err := vm.prog.verify()
+	if err != nil {
+		vm.opPC = err.(*VerifyError).Addr
+		vm.fault(ErrInvalidProgram, "%s", err.(*VerifyError).Msg)
+		return vm.err
+	}
+	vm.starts = starts
+	vm.flags.isa1 = vm.prog.ISAVersion == 1
+
+	vm.hostNames = make(map[int64][]string, len(vm.prog.Constants))
+	for _, c := range vm.prog.Constants {
+		id := HostID(string(c))
+		vm.hostNames[id] = append(vm.hostNames[id], string(c))
+	}
+	return nil
+}
+
+// Append adds code to the end of the program and moves the program counter to
+// it, so the next Run executes the new code. Any error from the last Run is
+// cleared so a machine that faulted can carry on. Labels in the code must
+// already be resolved. If the code doesn't verify the program is left as it was.
+func (vm *VM) Append(code []byte) error {
+	if vm.prog.ISAVersion != ISAVersion {
+		return errors.New("Only programs using the current instruction set can be extended")
+	}
+
+	start := int64(len(vm.prog.Code))
+	vm.prog.Code = append(vm.prog.Code, code...)
+	starts, err := vm.prog.verify()
+	if err != nil {
+		vm.prog.Code = vm.prog.Code[:start]
+		return err
+	}
+
+	vm.program = vm.prog.Code
+	vm.starts = starts
+	vm.err = nil
+	vm.setPC(start)
+	return nil
+}
+
+// stepPrompt shows the machine state and waits for the user before executing
+// the next instruction.
+func (vm *VM) stepPrompt(code byte) {
+	vm.printRegisters(vm.stderr)
+	fmt.Fprint(vm.stderr, "Stack: ")
+	vm.printStack(vm.stderr)
+	fmt.Fprintf(vm.stderr, "Instruction: %s; Flags: zero = %d\n", instructions[code], vm.flags.zero)
+	fmt.Fprint(vm.stderr, "> ")
+	resp, err := vm.stdin.ReadBytes('\n')
+	if err != nil || bytes.Equal(resp, []byte("continue\n")) {
+		// Nothing more can be read so don't keep prompting
+		vm.flags.step = false
+		vm.flags.noStep = true
+	} else if bytes.Equal(resp, []byte("next\n")) {
+		vm.flags.step = false
+	}
+}
+
 func (vm *VM) fetch() byte {
 	nextpc := vm.registers[PC].iVal
-	if nextpc >= int64(len(vm.program)) {
-		panic("Reached end of program with no HALT instruction, halting")
+	if uint64(nextpc) >= uint64(len(vm.program)) {
+		vm.endOfProgram()
+		return 0
 	}
-	c := vm.program[nextpc]
-	vm.registers[PC].iVal++
-	return c
+	vm.registers[PC].iVal = nextpc + 1
+	return vm.program[nextpc]
+}
+
+// The faults raised by fetching and by the stack are kept out of line so the
+// functions checking for them stay small enough to be inlined
+
+//go:noinline
+func (vm *VM) endOfProgram() {
+	vm.fault(ErrEndOfProgram, "reached end of program with no HALT instruction")
+}
+
+//go:noinline
+func (vm *VM) stackFull() {
+	vm.fault(ErrStackOverflow, "stack is full, depth %d", vm.registers[SP].iVal)
+}
+
+//go:noinline
+func (vm *VM) stackUnderflow() {
+	vm.fault(ErrStackUnderflow, "not enough values on the stack, depth %d", vm.registers[SP].iVal)
 }
 
 func (vm *VM) setPC(v int64) {
 	vm.registers[PC].iVal = v
 }
 
+// setRegister copies a value into a register. $SP can only be moved within
+// the slots of the stack that have held values, so every value below it exists.
+// Writing $PC is a jump and is checked like one.
+func (vm *VM) setRegister(reg byte, v *vmValue) {
+	if reg == PC || reg == SP {
+		if kind, msg := vm.checkRegister(reg, v); msg != "" {
+			vm.fault(kind, "%s", msg)
+			return
+		}
+	}
+	*vm.registers[reg] = *v
+}
+
+// checkRegister returns the kind of fault writing v to reg causes and why,
+// or an empty message if it can be written
+func (vm *VM) checkRegister(reg byte, v *vmValue) (ErrorKind, string) {
+	switch reg {
+	case PC:
+		if v.t != regInt {
+			return ErrTypeMismatch, "$PC can only be set to an integer"
+		}
+		if !vm.IsInstruction(v.iVal) {
+			return ErrInvalidJump, fmt.Sprintf("0x%X is not an instruction", v.iVal)
+		}
+	case SP:
+		if v.t != regInt {
+			return ErrTypeMismatch, "$SP can only be set to an integer"
+		}
+		if v.iVal < 0 || v.iVal > int64(len(vm.stack)) || (v.iVal > 0 && vm.stack[v.iVal-1] == nil) {
+			return ErrInvalidOperand, fmt.Sprintf("$SP can't be set to %d, past the values on the stack", v.iVal)
+		}
+	}
+	return 0, ""
+}
+
 func (vm *VM) getPC() int64 {
 	return vm.registers[PC].iVal
 }
 
+// checkPush faults if there's no room on the stack for another value.
+func (vm *VM) checkPush() bool {
+	if uint64(vm.registers[SP].iVal) >= uint64(len(vm.stack)) {
+		vm.stackFull()
+		return false
+	}
+	return true
+}
+
+// checkDepth faults if the stack doesn't hold at least n values.
+func (vm *VM) checkDepth(n int64) bool {
+	csp := vm.registers[SP].iVal
+	if csp < n || csp > int64(len(vm.stack)) {
+		vm.stackUnderflow()
+		return false
+	}
+	return true
+}
+
+// pushStack copies a value onto the stack
 func (vm *VM) pushStack(v *vmValue) {
-	vm.stack[vm.registers[SP].iVal] = v
+	if !vm.checkPush() {
+		return
+	}
+
+	csp := vm.registers[SP].iVal
+	if vm.stack[csp] == nil {
+		vm.stack[csp] = &vmValue{}
+	}
+
+	*vm.stack[csp] = *v
 	vm.registers[SP].iVal++
 }
 
 func (vm *VM) pushStackI(v int64) {
+	if !vm.checkPush() {
+		return
+	}
+
 	csp := vm.registers[SP].iVal
 	if vm.stack[csp] == nil {
 		vm.stack[csp] = &vmValue{}
 	}
 
-	vm.stack[csp].t = regInt
-	vm.stack[csp].iVal = v
+	*vm.stack[csp] = vmValue{t: regInt, iVal: v}
+	vm.registers[SP].iVal++
+}
+
+func (vm *VM) pushStackF(v float64) {
+	if !vm.checkPush() {
+		return
+	}
+
+	csp := vm.registers[SP].iVal
+	if vm.stack[csp] == nil {
+		vm.stack[csp] = &vmValue{}
+	}
+
+	*vm.stack[csp] = vmValue{t: regFloat, fVal: v}
 	vm.registers[SP].iVal++
 }
 
 func (vm *VM) pushStackStr(v []byte) {
+	if !vm.checkPush() {
+		return
+	}
+
 	csp := vm.registers[SP].iVal
 	if vm.stack[csp] == nil {
 		vm.stack[csp] = &vmValue{}
 	}
 
-	vm.stack[csp].t = regStr
-	vm.stack[csp].sVal = v
+	*vm.stack[csp] = vmValue{t: regStr, sVal: v}
 	vm.registers[SP].iVal++
 }
 
+// popStack removes TOS and returns its slot. Slots are reused, so the value
+// only lasts until the next push and must be copied to be kept.
 func (vm *VM) popStack() *vmValue {
-	vm.registers[SP].iVal--
-	sv := vm.stack[vm.registers[SP].iVal]
-	return &vmValue{
-		t:    sv.t,
-		iVal: sv.iVal,
-		sVal: sv.sVal,
+	if !vm.checkDepth(1) {
+		return &vmValue{}
 	}
+
+	vm.registers[SP].iVal--
+	return vm.stack[vm.registers[SP].iVal]
 }
 
+// getTOS returns the slot of TOS, which like popStack's must be copied to be kept
 func (vm *VM) getTOS() *vmValue {
-	sv := vm.stack[vm.registers[SP].iVal-1]
-	return &vmValue{
-		t:    sv.t,
-		iVal: sv.iVal,
-		sVal: sv.sVal,
+	if !vm.checkDepth(1) {
+		return &vmValue{}
 	}
+
+	return vm.stack[vm.registers[SP].iVal-1]
 }
 
-func (vm *VM) printStack() {
-	if vm.registers[SP].iVal == 0 {
-		fmt.Println("[]")
+func (vm *VM) printStack(w io.Writer) {
+	sp := vm.registers[SP].iVal
+	if sp > int64(len(vm.stack)) {
+		sp = int64(len(vm.stack))
+	}
+	for sp > 0 && vm.stack[sp-1] == nil {
+		sp--
+	}
+	if sp <= 0 {
+		fmt.Fprintln(w, "[]")
 		return
 	}
 
-	sp := vm.registers[SP].iVal - 1
+	sp--
 	var out bytes.Buffer
 	out.WriteByte('[')
 
 	for sp >= 0 {
-		if vm.stack[sp].t == regInt {
+		switch vm.stack[sp].t {
+		case regInt:
 			out.WriteString("0x")
 			out.WriteString(strconv.FormatInt(vm.stack[sp].iVal, 16))
-		} else {
+		case regFloat:
+			out.WriteString(formatFloat(vm.stack[sp].fVal))
+		case regArr:
+			out.WriteString(vm.stack[sp].format())
+		default:
 			out.Write(vm.stack[sp].sVal)
 		}
 		if sp > 0 {
@@ -287,12 +716,12 @@ func (vm *VM) printStack() {
 	}
 
 	out.WriteByte(']')
-	fmt.Println(out.String())
+	fmt.Fprintln(w, out.String())
 }
 
-func (vm *VM) printRegisters() {
+func (vm *VM) printRegisters(w io.Writer) {
 	i := byte(0)
-	fmt.Printf("| PC: 0x%X | SP: 0x%X | FP: 0x%X | RT: 0x%X | ",
+	fmt.Fprintf(w, "| PC: 0x%X | SP: 0x%X | FP: 0x%X | RT: 0x%X | ",
 		vm.registers[PC].iVal,
 		vm.registers[SP].iVal,
 		vm.registers[FP].iVal,
@@ -300,12 +729,15 @@ func (vm *VM) printRegisters() {
 	)
 
 	for i < totalUserRegisters {
-		if vm.registers[i].t == regInt {
-			fmt.Printf("%c: 0x%X | ", 'A'+i, vm.registers[i].iVal)
-		} else {
-			fmt.Printf("%c: %q | ", 'A'+i, vm.registers[i].sVal)
+		switch vm.registers[i].t {
+		case regInt:
+			fmt.Fprintf(w, "%c: 0x%X | ", 'A'+i, vm.registers[i].iVal)
+		case regFloat, regArr:
+			fmt.Fprintf(w, "%c: %s | ", 'A'+i, vm.registers[i].format())
+		default:
+			fmt.Fprintf(w, "%c: %q | ", 'A'+i, vm.registers[i].sVal)
 		}
 		i++
 	}
-	fmt.Println("")
+	fmt.Fprintln(w, "")
 }